@@ -0,0 +1,69 @@
+// Cache statistics and administration
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// wantJSON returns true if the client asked for a JSON response,
+// either with the "format" parameter, or with the Accept header.
+func wantJSON(r *http.Request) bool {
+	if f := r.FormValue("format"); f != "" {
+		return f == "json"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeJSON sends "v", encoded as JSON, with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// cacheAdminHandler serves the cache statistics (GET), as an HTML
+// page or as JSON, and purges cache entries (POST or DELETE). The
+// "id" parameter selects the entry to purge; if it is missing (or
+// zero) all entries are purged, including the entries of the
+// encoded-images cache.
+func cacheAdminHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+		st := imgCache.ReqStats()
+		st.Encoded = encImgCache.ReqStats()
+		if wantJSON(r) {
+			writeJSON(w, http.StatusOK, st)
+			return
+		}
+		renderTmpl(w, "cache", st)
+	case "POST", "DELETE":
+		var id int64
+		if s := r.FormValue("id"); s != "" {
+			var err error
+			id, err = strconv.ParseInt(s, 10, 64)
+			if err != nil || id < 0 {
+				http.Error(w, "Bad entry id",
+					http.StatusBadRequest)
+				return
+			}
+		}
+		n := imgCache.ReqPurge(id)
+		if id == 0 {
+			n += encImgCache.ReqPurge()
+		}
+		if r.Method == "DELETE" || wantJSON(r) {
+			writeJSON(w, http.StatusOK,
+				map[string]int{"purged": n})
+			return
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		http.Error(w, "Method not allowed",
+			http.StatusMethodNotAllowed)
+	}
+}
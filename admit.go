@@ -0,0 +1,235 @@
+// Render cost estimation and admission control
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Min Retry-After value for rejected requests
+const minRetry = time.Second
+
+// renderCost returns the estimated cost of rendering the image with
+// parameters "p": The max number of iterations to perform (pixels
+// times iterations). Images that are cached (or being rendered) cost
+// nothing, and images that can be refined from cached ones cost only
+// the additional iterations.
+func renderCost(p *params) int64 {
+	iter := p.Iter - imgCache.ReqPeek(p)
+	return int64(p.Sx) * int64(p.Sy) * int64(iter)
+}
+
+// admitLimits are the admission-control limits. Zero values (except
+// for MaxWait) mean no limit. Costs are in millions of iterations (see
+// renderCost).
+type admitLimits struct {
+	// Max cost of a single render
+	MaxCost int64 `json:"max_cost"`
+	// Max number, and total cost, of renders in progress
+	MaxRenders   int   `json:"max_renders"`
+	MaxTotalCost int64 `json:"max_total_cost"`
+	// Max number of renders in progress (or waiting) per client
+	MaxClientRenders int `json:"max_client_renders"`
+	// Max time a render waits to be admitted (seconds; zero: don't
+	// wait)
+	MaxWait float64 `json:"max_wait"`
+}
+
+// admitter limits the number and the total cost of the renders in
+// progress, globally and per client. Renders that cannot be admitted
+// immediately wait for others to finish, up to a time limit. It is
+// safe for concurrent use. A nil *admitter admits everything.
+type admitter struct {
+	lim admitLimits
+	mu  sync.Mutex
+	// Number, and total cost, of renders in progress
+	renders int
+	cost    int64
+	// Renders in progress (or waiting), per client
+	clients map[string]int
+	// Closed (and replaced) when a render finishes
+	released chan struct{}
+}
+
+// admitError is returned when a render is not admitted.
+type admitError struct {
+	// HTTP status code to respond with
+	code int
+	// Time after which the client may retry (zero: don't retry)
+	retry time.Duration
+	msg   string
+}
+
+func (e *admitError) Error() string { return e.msg }
+
+func newAdmitter(lim admitLimits) *admitter {
+	return &admitter{
+		lim:      lim,
+		clients:  make(map[string]int),
+		released: make(chan struct{}),
+	}
+}
+
+// limits returns the admitter's limits.
+func (a *admitter) limits() *admitLimits {
+	if a == nil {
+		return nil
+	}
+	lim := a.lim
+	return &lim
+}
+
+// check returns an error if a render of the given cost must never be
+// admitted (it costs more than the max cost of a single render).
+func (a *admitter) check(cost int64) error {
+	if a == nil || a.lim.MaxCost <= 0 || cost <= a.lim.MaxCost*1e6 {
+		return nil
+	}
+	return &admitError{
+		code: http.StatusBadRequest,
+		msg: fmt.Sprintf("Render cost (%dM iterations) exceeds "+
+			"limit (%dM); reduce the image size or the "+
+			"iteration count", cost/1e6, a.lim.MaxCost),
+	}
+}
+
+// fits returns true if a render of the given cost can be admitted
+// now. Must be called with a.mu held.
+func (a *admitter) fits(cost int64) bool {
+	if a.renders == 0 {
+		return true
+	}
+	return (a.lim.MaxRenders <= 0 || a.renders < a.lim.MaxRenders) &&
+		(a.lim.MaxTotalCost <= 0 ||
+			a.cost+cost <= a.lim.MaxTotalCost*1e6)
+}
+
+// acquire admits a render of the given cost, for the given client,
+// waiting (up to the max wait time) if it cannot be admitted
+// immediately. Returns a function that must be called when the
+// render finishes. Returns an *admitError if the render is not
+// admitted, or ctx.Err() if ctx is done while waiting.
+func (a *admitter) acquire(ctx context.Context, client string,
+	cost int64) (func(), error) {
+	if a == nil || cost == 0 {
+		return func() {}, nil
+	}
+	if err := a.check(cost); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	if a.lim.MaxClientRenders > 0 &&
+		a.clients[client] >= a.lim.MaxClientRenders {
+		a.mu.Unlock()
+		return nil, &admitError{
+			code:  http.StatusTooManyRequests,
+			retry: minRetry,
+			msg:   "Too many renders in progress for client",
+		}
+	}
+	a.clients[client]++
+	a.mu.Unlock()
+	wait := time.Duration(a.lim.MaxWait * float64(time.Second))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		a.mu.Lock()
+		if a.fits(cost) {
+			a.renders++
+			a.cost += cost
+			a.mu.Unlock()
+			rel := func() { a.release(client, cost) }
+			var once sync.Once
+			return func() { once.Do(rel) }, nil
+		}
+		ch := a.released
+		a.mu.Unlock()
+		var err error
+		select {
+		case <-ch:
+			continue
+		case <-timer.C:
+			err = &admitError{
+				code:  http.StatusServiceUnavailable,
+				retry: wait + minRetry,
+				msg:   "Server busy; too many renders in progress",
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		a.mu.Lock()
+		a.dropClient(client)
+		a.mu.Unlock()
+		return nil, err
+	}
+}
+
+// dropClient decrements the number of renders of the client. Must be
+// called with a.mu held.
+func (a *admitter) dropClient(client string) {
+	if a.clients[client]--; a.clients[client] <= 0 {
+		delete(a.clients, client)
+	}
+}
+
+// release records that a render (admitted by acquire) finished, and
+// wakes up the renders waiting to be admitted.
+func (a *admitter) release(client string, cost int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.renders--
+	a.cost -= cost
+	a.dropClient(client)
+	close(a.released)
+	a.released = make(chan struct{})
+}
+
+var admission *admitter
+
+// clientAddr returns the address of the client that sent request
+// "r": The first address in the X-Forwarded-For header, if flag
+// -trust-proxy is set and the header is present, or the request's
+// remote address otherwise.
+func clientAddr(r *http.Request) string {
+	if *trustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return strings.TrimSpace(strings.Split(xff, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// admitRender admits the render of the image with parameters "p" for
+// request "r" (see admitter.acquire).
+func admitRender(r *http.Request, p *params) (func(), error) {
+	if admission == nil {
+		return func() {}, nil
+	}
+	return admission.acquire(r.Context(), clientAddr(r), renderCost(p))
+}
+
+// admitStatus returns the HTTP status code to respond with when a
+// render was not admitted with error "err", and sets the Retry-After
+// header, if appropriate.
+func admitStatus(w http.ResponseWriter, err error) int {
+	ae, ok := err.(*admitError)
+	if !ok {
+		return renderStatus(err)
+	}
+	if ae.retry > 0 {
+		secs := int((ae.retry + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	return ae.code
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAdmitter(t *testing.T) {
+	a := newAdmitter(admitLimits{MaxCost: 100, MaxRenders: 2,
+		MaxTotalCost: 150, MaxClientRenders: 2, MaxWait: 0.05})
+	ctx := context.Background()
+	code := func(err error) int {
+		if ae, ok := err.(*admitError); ok {
+			return ae.code
+		}
+		t.Fatalf("not an admitError: %v", err)
+		return 0
+	}
+	// Single render above max cost
+	if _, err := a.acquire(ctx, "a", 101e6); code(err) != http.StatusBadRequest {
+		t.Fatalf("max cost: %v", err)
+	}
+	// Cached images are always admitted
+	if _, err := a.acquire(ctx, "a", 0); err != nil {
+		t.Fatalf("zero cost: %v", err)
+	}
+	r1, err := a.acquire(ctx, "a", 100e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Total cost exceeded: waits, then fails
+	if _, err := a.acquire(ctx, "b", 60e6); code(err) != http.StatusServiceUnavailable {
+		t.Fatalf("max total cost: %v", err)
+	}
+	r2, err := a.acquire(ctx, "a", 50e6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Client limit
+	if _, err := a.acquire(ctx, "a", 1e6); code(err) != http.StatusTooManyRequests {
+		t.Fatalf("max client renders: %v", err)
+	}
+	// Waiting render is admitted when another finishes
+	done := make(chan error)
+	go func() {
+		r, err := a.acquire(ctx, "b", 10e6)
+		if err == nil {
+			r()
+		}
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r1()
+	r1() // Releasing twice is harmless
+	if err := <-done; err != nil {
+		t.Fatalf("waiting render: %v", err)
+	}
+	r2()
+	if a.renders != 0 || a.cost != 0 || len(a.clients) != 0 {
+		t.Fatalf("not released: %d, %d, %v", a.renders, a.cost, a.clients)
+	}
+	// Canceled while waiting
+	r1, _ = a.acquire(ctx, "a", 100e6)
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := a.acquire(cctx, "b", 100e6); err != context.Canceled {
+		t.Fatalf("canceled: %v", err)
+	}
+	r1()
+}
+
+func TestRenderCost(t *testing.T) {
+	saved := imgCache
+	defer func() { imgCache = saved }()
+	imgCache = newCache(1 << 30)
+	p := &params{Sx: 32, Sy: 32, Iter: 64,
+		X0: -2.0, Y0: -1.2, X1: 1.0, Y1: 1.2}
+	if c := renderCost(p); c != 32*32*64 {
+		t.Fatalf("cost %d", c)
+	}
+	m, err := newMandelImg(context.Background(), 32, 32, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 16, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgCache.ReqAdd(m, false)
+	// Can be refined from cached image
+	if c := renderCost(p); c != 32*32*(64-16) {
+		t.Fatalf("refine cost %d", c)
+	}
+	p.Iter = 16
+	if c := renderCost(p); c != 0 {
+		t.Fatalf("cached cost %d", c)
+	}
+}
@@ -0,0 +1,133 @@
+// Palette color-cycling animations
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"net/http"
+)
+
+const (
+	// Number of animation frames
+	minFrames = 2
+	maxFrames = 128
+	dflFrames = 32
+	// Delay between frames (in 100ths of a second)
+	minDelay = 2
+	maxDelay = 100
+	dflDelay = 8
+	// Max total number of pixels in all animation frames
+	maxAnimPix = 128 * 1024 * 1024
+)
+
+// Paletted converts the image to an *image.Paletted, with the same
+// palette. Returns non-nil error if the image's palette has more than
+// 256 colors (the max supported by image.Paletted).
+func (m *mandelImg) Paletted() (*image.Paletted, error) {
+	if len(m.Palette) > 256 {
+		return nil, errors.New("Paletted: Too many colors")
+	}
+	pi := image.NewPaletted(m.Bounds(), m.Palette)
+	for y := 0; y < m.h; y++ {
+		for x := 0; x < m.w; x++ {
+			of := m.pixOffset(x, y)
+			pi.Pix[pi.PixOffset(x, y)] = uint8(m.colorIndex(of))
+		}
+	}
+	return pi, nil
+}
+
+// cycleAnim creates an animation of "frames" frames by rotating the
+// palette of image "m", starting from the image's palette offset, so
+// that the palette completes a full cycle over the animation. All
+// frames use the cyclic mapping (see palIndex), so that the colors do
+// not jump when the animation loops. Frames are "delay" 100ths of a
+// second apart. The pixel data of the image
+// are not recalculated. Returns non-nil error if the image cannot be
+// converted to a paletted image.
+func cycleAnim(m *mandelImg, frames, delay int) (*gif.GIF, error) {
+	g := &gif.GIF{
+		Image: make([]*image.Paletted, frames),
+		Delay: make([]int, frames),
+	}
+	cm := m.CMap
+	cm.Cyclic = true
+	off := cm.Offset
+	for i := 0; i < frames; i++ {
+		cm.Offset = off + float64(i)/float64(frames)
+		if cm.Offset >= 1.0 {
+			cm.Offset -= 1.0
+		}
+		pi, err := m.Remap(cm).Paletted()
+		if err != nil {
+			return nil, err
+		}
+		g.Image[i] = pi
+		g.Delay[i] = delay
+	}
+	return g, nil
+}
+
+// animFrames returns the number of frames of a w x h animation, given
+// the number requested: If the frames would exceed maxAnimPix pixels
+// in total, the number is reduced. Returns non-nil error if even
+// minFrames frames exceed maxAnimPix.
+func animFrames(frames, w, h int) (int, error) {
+	if minFrames*w*h > maxAnimPix {
+		return 0, errors.New("Image too large for an animation")
+	}
+	if frames*w*h > maxAnimPix {
+		frames = maxAnimPix / (w * h)
+	}
+	return frames, nil
+}
+
+func animHandler(w http.ResponseWriter, r *http.Request) {
+	p := getParams(r)
+	frames := valInt(&p.Errors, r, "frames",
+		minFrames, maxFrames, dflFrames)
+	delay := valInt(&p.Errors, r, "delay", minDelay, maxDelay, dflDelay)
+	if p.Strict && p.Errors != nil {
+		paramsError(w, r, p.Errors)
+		return
+	}
+	frames, err := animFrames(frames, p.Sx, p.Sy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	encKey := fmt.Sprintf("gif:%d:%d:%s", frames, delay, p.etag())
+	if b := encImgCache.ReqLookup(encKey); b != nil {
+		cacheForever(w)
+		w.Header().Set("Content-Type", "image/gif")
+		w.Write(b)
+		return
+	}
+	release, err := admitRender(r, p)
+	if err != nil {
+		http.Error(w, err.Error(), admitStatus(w, err))
+		return
+	}
+	img, err := getImg(r.Context(), p)
+	release()
+	if err != nil {
+		http.Error(w, err.Error(), renderStatus(err))
+		return
+	}
+	g, err := cycleAnim(img, frames, delay)
+	if err != nil {
+		http.Error(w, err.Error(),
+			http.StatusInternalServerError)
+		return
+	}
+	cacheForever(w)
+	w.Header().Set("Content-Type", "image/gif")
+	var buf bytes.Buffer
+	gif.EncodeAll(&buf, g)
+	encImgCache.ReqAdd(encKey, buf.Bytes())
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"testing"
+)
+
+func TestPaletted(t *testing.T) {
+	m, err := newMandelImg(context.Background(), 40, 30, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 32, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.CMap.Offset = 0.3
+	pi, err := m.Paletted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Bounds() != m.Bounds() {
+		t.Fatalf("bounds %v", pi.Bounds())
+	}
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			r0, g0, b0, a0 := m.At(x, y).RGBA()
+			r1, g1, b1, a1 := pi.At(x, y).RGBA()
+			if r0 != r1 || g0 != g1 || b0 != b1 || a0 != a1 {
+				t.Fatalf("(%d, %d): %v != %v",
+					x, y, pi.At(x, y), m.At(x, y))
+			}
+		}
+	}
+
+	big := m.Repalette(make(color.Palette, 257))
+	if _, err := big.Paletted(); err == nil {
+		t.Error("converted image with 257 colors")
+	}
+}
+
+func TestCycleAnim(t *testing.T) {
+	m, err := newMandelImg(context.Background(), 40, 30, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 32, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.CMap.Offset = 0.5
+	g, err := cycleAnim(m, 4, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 4 || len(g.Delay) != 4 {
+		t.Fatalf("%d frames, %d delays", len(g.Image), len(g.Delay))
+	}
+	// Frame i is rendered with the offset advanced by i/4 (mod 1)
+	for i, off := range []float64{0.5, 0.75, 0, 0.25} {
+		cm := m.CMap
+		cm.Offset, cm.Cyclic = off, true
+		want, _ := m.Remap(cm).Paletted()
+		pi := g.Image[i]
+		if g.Delay[i] != 7 {
+			t.Errorf("frame %d: delay %d", i, g.Delay[i])
+		}
+		for j := range pi.Pix {
+			if pi.Pix[j] != want.Pix[j] {
+				t.Fatalf("frame %d: pixel %d: %d != %d",
+					i, j, pi.Pix[j], want.Pix[j])
+			}
+		}
+	}
+}
+
+func TestCycleAnimLoop(t *testing.T) {
+	m, err := newMandelImg(context.Background(), 40, 30, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 32, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Offset 0: Frame 0 uses the cyclic mapping, like the other
+	// frames, not the default one
+	g, err := cycleAnim(m, 4, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm := m.CMap
+	cm.Cyclic = true
+	want, _ := m.Remap(cm).Paletted()
+	def, _ := m.Paletted()
+	same := true
+	for j, c := range g.Image[0].Pix {
+		if c != want.Pix[j] {
+			t.Fatalf("pixel %d: %d != %d", j, c, want.Pix[j])
+		}
+		same = same && c == def.Pix[j]
+	}
+	if same {
+		t.Error("frame 0 uses the default mapping")
+	}
+}
+
+func TestAnimFrames(t *testing.T) {
+	tests := []struct {
+		frames, w, h, want int
+	}{
+		{32, 640, 480, 32},
+		{128, 2048, 2048, 32},
+		{32, 8192, 8192, 2},
+		{32, 10240, 8192, 0},
+	}
+	for _, tc := range tests {
+		n, err := animFrames(tc.frames, tc.w, tc.h)
+		if n != tc.want || (err != nil) != (tc.want == 0) {
+			t.Errorf("%d x %dx%d: %d, %v",
+				tc.frames, tc.w, tc.h, n, err)
+		}
+		if err == nil && n*tc.w*tc.h > maxAnimPix {
+			t.Errorf("%d x %dx%d: %d frames too many",
+				tc.frames, tc.w, tc.h, n)
+		}
+	}
+}
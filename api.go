@@ -0,0 +1,366 @@
+// JSON API (version 1) for rendering images and querying metadata
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"image/color"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Max size of a JSON request body (in bytes)
+const apiMaxBody = 64 * 1024
+
+// apiErrors is the body of API error responses.
+type apiErrors struct {
+	Errors fieldErrors `json:"errors"`
+}
+
+// writeAPIErrors sends the errors "fe" with the given status code.
+func writeAPIErrors(w http.ResponseWriter, code int, fe fieldErrors) {
+	writeJSON(w, code, apiErrors{fe})
+}
+
+type intLimit struct {
+	Min     int `json:"min"`
+	Max     int `json:"max"`
+	Default int `json:"default"`
+}
+
+type floatLimit struct {
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Default float64 `json:"default"`
+}
+
+// domainLimit is the range of the coordinates along an axis. The
+// default domain spans the whole range.
+type domainLimit struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// apiLimits are the allowed ranges, and the defaults, of the render
+// spec fields.
+type apiLimits struct {
+	Width         intLimit    `json:"width"`
+	Height        intLimit    `json:"height"`
+	Iter          intLimit    `json:"iter"`
+	X             domainLimit `json:"x"`
+	Y             domainLimit `json:"y"`
+	PaletteOffset floatLimit  `json:"palette_offset"`
+	PaletteRepeat intLimit    `json:"palette_repeat"`
+	PaletteGamma  floatLimit  `json:"palette_gamma"`
+	Contrast      floatLimit  `json:"contrast"`
+	// Default palette and mapping function
+	Palette string `json:"palette"`
+	Map     string `json:"map"`
+	// Number of colors of custom palettes
+	CustomPaletteSize int `json:"custom_palette_size"`
+	// Admission-control limits (if enabled)
+	Admission *admitLimits `json:"admission,omitempty"`
+}
+
+var limits = apiLimits{
+	Width:             intLimit{minSx, maxSx, dflSx},
+	Height:            intLimit{minSy, maxSy, dflSy},
+	Iter:              intLimit{minIter, maxIter, dflIter},
+	X:                 domainLimit{minX, maxX},
+	Y:                 domainLimit{minY, maxY},
+	PaletteOffset:     floatLimit{minPOff, maxPOff, dflPOff},
+	PaletteRepeat:     intLimit{minPRep, maxPRep, dflPRep},
+	PaletteGamma:      floatLimit{minPGam, maxPGam, dflPGam},
+	Contrast:          floatLimit{minCon, maxCon, dflCon},
+	Palette:           dflPal,
+	Map:               dflMap,
+	CustomPaletteSize: custPalSize,
+}
+
+// renderSpec is the body of render requests. Missing (nil) fields
+// take their default values.
+type renderSpec struct {
+	Width          *int     `json:"width,omitempty"`
+	Height         *int     `json:"height,omitempty"`
+	Iter           *int     `json:"iter,omitempty"`
+	X0             *float64 `json:"x0,omitempty"`
+	Y0             *float64 `json:"y0,omitempty"`
+	X1             *float64 `json:"x1,omitempty"`
+	Y1             *float64 `json:"y1,omitempty"`
+	Palette        *string  `json:"palette,omitempty"`
+	CustomPalette  *string  `json:"custom_palette,omitempty"`
+	PaletteOffset  *float64 `json:"palette_offset,omitempty"`
+	PaletteRepeat  *int     `json:"palette_repeat,omitempty"`
+	PaletteReverse *bool    `json:"palette_reverse,omitempty"`
+	PaletteGamma   *float64 `json:"palette_gamma,omitempty"`
+	Map            *string  `json:"map,omitempty"`
+	Contrast       *float64 `json:"contrast,omitempty"`
+}
+
+func specInt(fe *fieldErrors, field string, v *int, l intLimit) int {
+	if v == nil {
+		return l.Default
+	}
+	if *v < l.Min || *v > l.Max {
+		fe.add(field, "must be between %d and %d", l.Min, l.Max)
+	}
+	return *v
+}
+
+func specFloat(fe *fieldErrors, field string,
+	v *float64, l floatLimit) float64 {
+	if v == nil {
+		return l.Default
+	}
+	if *v < l.Min || *v > l.Max {
+		fe.add(field, "must be between %g and %g", l.Min, l.Max)
+	}
+	return *v
+}
+
+// params validates the render spec and converts it to image
+// parameters. Palette names are looked-up among the palettes
+// available to request "r". Returns the errors for all invalid
+// fields (and nil parameters) if any field is invalid.
+func (s *renderSpec) params(r *http.Request) (*params, fieldErrors) {
+	var fe fieldErrors
+	p := &params{}
+	p.Sx = specInt(&fe, "width", s.Width, limits.Width)
+	p.Sy = specInt(&fe, "height", s.Height, limits.Height)
+	p.Iter = specInt(&fe, "iter", s.Iter, limits.Iter)
+	p.X0 = specFloat(&fe, "x0", s.X0, floatLimit{minX, maxX, dflX0})
+	p.X1 = specFloat(&fe, "x1", s.X1, floatLimit{minX, maxX, dflX1})
+	p.Y0 = specFloat(&fe, "y0", s.Y0, floatLimit{minY, maxY, dflY0})
+	p.Y1 = specFloat(&fe, "y1", s.Y1, floatLimit{minY, maxY, dflY1})
+	if p.X1 <= p.X0 {
+		fe.add("x1", "must be greater than x0")
+	}
+	if p.Y1 <= p.Y0 {
+		fe.add("y1", "must be greater than y0")
+	}
+	p.Palettes, p.palStops = sessions.palettes(r)
+	p.Pal = dflPal
+	if s.Palette != nil {
+		p.Pal = *s.Palette
+		if _, ok := p.Palettes[p.Pal]; !ok {
+			fe.add("palette", "unknown palette %q", p.Pal)
+		}
+	}
+	if s.CustomPalette != nil && *s.CustomPalette != "" {
+		pts, err := parsePalSpec(*s.CustomPalette, custPalSize)
+		if err != nil {
+			fe.add("custom_palette", "%v", err)
+		} else {
+			p.cpal = make(color.Palette, custPalSize)
+			linGrad(pts, p.cpal)
+			p.CPal = fmtPalSpec(pts)
+		}
+	}
+	p.POff = specFloat(&fe, "palette_offset", s.PaletteOffset,
+		limits.PaletteOffset)
+	if p.POff == maxPOff {
+		p.POff = minPOff
+	}
+	p.PRep = specInt(&fe, "palette_repeat", s.PaletteRepeat,
+		limits.PaletteRepeat)
+	if s.PaletteReverse != nil {
+		p.PRev = *s.PaletteReverse
+	}
+	p.PGam = specFloat(&fe, "palette_gamma", s.PaletteGamma,
+		limits.PaletteGamma)
+	p.MapFuncs = mapFuncs
+	p.Map = dflMap
+	if s.Map != nil {
+		p.Map = *s.Map
+		if _, ok := mapFuncs[p.Map]; !ok {
+			fe.add("map", "unknown mapping function %q", p.Map)
+		}
+	}
+	p.Con = specFloat(&fe, "contrast", s.Contrast, limits.Contrast)
+	if fe != nil {
+		return nil, fe
+	}
+	return p, nil
+}
+
+// paramsSpec returns the render spec (with all fields set) for image
+// parameters "p".
+func paramsSpec(p *params) renderSpec {
+	cpal := p.CPal
+	return renderSpec{
+		Width: &p.Sx, Height: &p.Sy, Iter: &p.Iter,
+		X0: &p.X0, Y0: &p.Y0, X1: &p.X1, Y1: &p.Y1,
+		Palette: &p.Pal, CustomPalette: &cpal,
+		PaletteOffset: &p.POff, PaletteRepeat: &p.PRep,
+		PaletteReverse: &p.PRev, PaletteGamma: &p.PGam,
+		Map: &p.Map, Contrast: &p.Con,
+	}
+}
+
+// histoSummary summarizes the iteration-count histogram of an image.
+type histoSummary struct {
+	// Pixels that did not escape (in the set)
+	Inside int `json:"inside"`
+	// Pixels that escaped
+	Escaped int `json:"escaped"`
+	// Min, max, mean, and median iteration count of the pixels
+	// that escaped (zero if none did)
+	MinIter    int     `json:"min_iter"`
+	MaxIter    int     `json:"max_iter"`
+	MeanIter   float64 `json:"mean_iter"`
+	MedianIter int     `json:"median_iter"`
+}
+
+// histoStats returns the histogram summary of image "m".
+func (m *mandelImg) histoStats() histoSummary {
+	hs := histoSummary{Inside: m.histo[m.MaxIter]}
+	var sum float64
+	for i, n := range m.histo[:m.MaxIter] {
+		if n == 0 {
+			continue
+		}
+		if hs.Escaped == 0 {
+			hs.MinIter = i
+		}
+		hs.MaxIter = i
+		hs.Escaped += n
+		sum += float64(i) * float64(n)
+	}
+	if hs.Escaped == 0 {
+		return hs
+	}
+	hs.MeanIter = sum / float64(hs.Escaped)
+	c := 0
+	for i, n := range m.histo[:m.MaxIter] {
+		c += n
+		if 2*c >= hs.Escaped {
+			hs.MedianIter = i
+			break
+		}
+	}
+	return hs
+}
+
+// renderResult is the body of successful render responses.
+type renderResult struct {
+	// URL of the rendered image (PNG)
+	ImageURL string `json:"image_url"`
+	// URL of the HTML page showing the image
+	PageURL string `json:"page_url"`
+	// The render spec, with all fields set
+	Spec renderSpec `json:"spec"`
+	// True if the image was found in the cache
+	CacheHit bool `json:"cache_hit"`
+	// Time it took to get (lookup or calculate) the image, in
+	// milliseconds
+	RenderMs float64 `json:"render_ms"`
+	// Summary of the image's iteration-count histogram
+	Histogram histoSummary `json:"histogram"`
+}
+
+// decodeJSON decodes the body of request "r" as JSON into "v".
+// Unknown fields are not allowed. Returns the errors to respond with,
+// if the body cannot be decoded.
+func decodeJSON(r *http.Request, v interface{}) fieldErrors {
+	var fe fieldErrors
+	dec := json.NewDecoder(io.LimitReader(r.Body, apiMaxBody))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	var te *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+	case errors.As(err, &te):
+		fe.add(te.Field, "must be of type %s", te.Type)
+	case err == io.EOF:
+		fe.add("", "empty request body")
+	default:
+		fe.add("", "%v", err)
+	}
+	return fe
+}
+
+// apiRenderHandler renders (or looks-up in the cache) the image
+// described by the JSON render spec posted, and responds with the
+// image's URLs and metadata.
+func apiRenderHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeAPIErrors(w, http.StatusMethodNotAllowed,
+			fieldErrors{{Error: "method must be POST"}})
+		return
+	}
+	var s renderSpec
+	if fe := decodeJSON(r, &s); fe != nil {
+		writeAPIErrors(w, http.StatusBadRequest, fe)
+		return
+	}
+	p, fe := s.params(r)
+	if fe != nil {
+		writeAPIErrors(w, http.StatusBadRequest, fe)
+		return
+	}
+	release, err := admitRender(r, p)
+	if err != nil {
+		writeAPIErrors(w, admitStatus(w, err),
+			fieldErrors{{Error: err.Error()}})
+		return
+	}
+	defer release()
+	start := time.Now()
+	ctx, cancel := renderContext(r.Context())
+	defer cancel()
+	img, hit, err := lookupImg(ctx, p, nil, nil)
+	if err != nil {
+		writeAPIErrors(w, renderStatus(err),
+			fieldErrors{{Error: err.Error()}})
+		return
+	}
+	writeJSON(w, http.StatusOK, renderResult{
+		ImageURL:  "/mandel?" + string(p.URL()),
+		PageURL:   "/?" + string(p.URL()),
+		Spec:      paramsSpec(p),
+		CacheHit:  hit,
+		RenderMs:  float64(time.Since(start)) / float64(time.Millisecond),
+		Histogram: img.histoStats(),
+	})
+}
+
+// apiPalette describes a palette available for rendering.
+type apiPalette struct {
+	Name string `json:"name"`
+	// Palette specification (see fmtPalSpec)
+	Spec string `json:"spec"`
+}
+
+// apiPalettesHandler responds with the palettes (including the
+// session's palettes) and the mapping functions available.
+func apiPalettesHandler(w http.ResponseWriter, r *http.Request) {
+	_, stops := sessions.palettes(r)
+	var resp struct {
+		Palettes []apiPalette `json:"palettes"`
+		Maps     []string     `json:"maps"`
+	}
+	for n, pts := range stops {
+		resp.Palettes = append(resp.Palettes,
+			apiPalette{n, fmtPalSpec(pts)})
+	}
+	sort.Slice(resp.Palettes, func(i, j int) bool {
+		return resp.Palettes[i].Name < resp.Palettes[j].Name
+	})
+	for n := range mapFuncs {
+		resp.Maps = append(resp.Maps, n)
+	}
+	sort.Strings(resp.Maps)
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// apiLimitsHandler responds with the allowed ranges and the defaults
+// of the render spec fields, and the admission-control limits.
+func apiLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	lim := limits
+	lim.Admission = admission.limits()
+	writeJSON(w, http.StatusOK, lim)
+}
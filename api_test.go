@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderSpec(t *testing.T) {
+	tests := []struct {
+		body   string
+		fields []string
+	}{
+		{`{}`, nil},
+		{`{"width": 800, "iter": 500, "palette": "Gold 1"}`, nil},
+		{`{"width": 10, "iter": 1000000}`, []string{"width", "iter"}},
+		{`{"x0": 0.5, "x1": 0.5}`, []string{"x1"}},
+		{`{"y0": -5}`, []string{"y0"}},
+		{`{"palette": "Nope", "map": "Nope"}`, []string{"palette", "map"}},
+		{`{"custom_palette": "0:zzzzzz"}`, []string{"custom_palette"}},
+		{`{"width": "big"}`, []string{"width"}},
+		{`{"bogus": 1}`, []string{""}},
+		{``, []string{""}},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("POST", "/api/v1/render",
+			strings.NewReader(tc.body))
+		var s renderSpec
+		fe := decodeJSON(r, &s)
+		var p *params
+		if fe == nil {
+			p, fe = s.params(r)
+		}
+		if len(fe) != len(tc.fields) {
+			t.Errorf("%s: errors %v, want fields %v",
+				tc.body, fe, tc.fields)
+			continue
+		}
+		for i := range fe {
+			if fe[i].Field != tc.fields[i] {
+				t.Errorf("%s: error %d field %q, want %q",
+					tc.body, i, fe[i].Field, tc.fields[i])
+			}
+		}
+		if fe == nil && p == nil {
+			t.Errorf("%s: nil params", tc.body)
+		}
+	}
+}
+
+func TestHistoStats(t *testing.T) {
+	m := &mandelImg{MaxIter: 10}
+	m.histo = []int{0, 0, 3, 1, 0, 0, 2, 0, 0, 0, 5}
+	hs := m.histoStats()
+	want := histoSummary{Inside: 5, Escaped: 6, MinIter: 2,
+		MaxIter: 6, MeanIter: 21.0 / 6, MedianIter: 2}
+	if hs != want {
+		t.Fatalf("histoStats: %+v, want %+v", hs, want)
+	}
+}
+
+func TestAPIRender(t *testing.T) {
+	saved := imgCache
+	defer func() { imgCache = saved }()
+	imgCache = newCache(1 << 30)
+	body := `{"width": 320, "height": 256, "iter": 32}`
+	for i, hit := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/render",
+			strings.NewReader(body))
+		apiRenderHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%d: status %d: %s", i, w.Code, w.Body)
+		}
+		var res renderResult
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res.CacheHit != hit {
+			t.Errorf("%d: cache_hit %v, want %v", i, res.CacheHit, hit)
+		}
+		if !strings.HasPrefix(res.ImageURL, "/mandel?sx=320&sy=256&iter=32&") {
+			t.Errorf("%d: image_url %s", i, res.ImageURL)
+		}
+		h := res.Histogram
+		if h.Inside+h.Escaped != 320*256 {
+			t.Errorf("%d: histogram %+v", i, h)
+		}
+	}
+	w := httptest.NewRecorder()
+	apiRenderHandler(w, httptest.NewRequest("GET", "/api/v1/render", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d", w.Code)
+	}
+}
@@ -4,22 +4,195 @@ package main
 
 import (
 	"container/list"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"time"
 )
 
-// cacheSize is the number of images to keep in the cache
-const cacheSize = 10
-
 type cache struct {
-	// List of *mandelImg (the cache itself)
+	// List of *cacheEntry (the cache itself), least recently used
+	// first
 	l *list.List
+	// Max total size of cached images (in bytes)
+	maxBytes int64
+	// Current total size of cached images (in bytes)
+	bytes int64
+	// Images being rendered (in-flight), keyed by image
+	// parameters
+	flights map[cacheKey]*flight
 	// Channel to receive add-image requests from
-	chAdd chan *mandelImg
+	chAdd chan addReq
 	// Channel to receive lookup-image requests from
 	chLookup chan lookupReq
+	// Channel to receive cancel-lookup requests from
+	chCancel chan lookupReq
+	// Channel to receive covering-image lookup requests from
+	chCover chan lookupReq
+	// Channel to receive refine-base lookup requests from
+	chBase chan lookupReq
+	// Channel to receive claim requests from
+	chClaim chan claimReq
+	// Channel to receive peek requests from
+	chPeek chan peekReq
+	// Channel to receive statistics requests from
+	chStats chan chan *cacheStats
+	// Channel to receive purge requests from
+	chPurge chan purgeReq
+	// Id of the last entry added
+	lastId int64
+	// Counters
+	cnt cacheCounters
+}
+
+// cacheEntry is an entry in the cache
+type cacheEntry struct {
+	img *mandelImg
+	// Unique entry id
+	id int64
+	// Time the entry was added, and last used
+	added, used time.Time
+	// Number of times the entry was used (including for deriving
+	// or refining images)
+	hits int64
+	// Image was prefetched
+	prefetched bool
+}
+
+// addReq is the cache-add request structure (send on cache.chAdd)
+type addReq struct {
+	img *mandelImg
+	// Image was prefetched
+	prefetched bool
+}
+
+// cacheCounters are the cache's event counters
+type cacheCounters struct {
+	// Lookups that found the image
+	Hits int64 `json:"hits"`
+	// Lookups that did not find the image (and its rendering
+	// was started)
+	Misses int64 `json:"misses"`
+	// Lookups that waited for the image to be rendered by
+	// another requester
+	Waits int64 `json:"waits"`
+	// Cached images used to derive images (see searchCover)
+	CoverHits int64 `json:"cover_hits"`
+	// Cached images used as refine-bases (see searchBase)
+	BaseHits int64 `json:"base_hits"`
+	// Images added
+	Adds int64 `json:"adds"`
+	// Images evicted
+	Evictions int64 `json:"evictions"`
+	// Images purged
+	Purges int64 `json:"purges"`
+	// Prefetched images added
+	Prefetches int64 `json:"prefetches"`
+	// Prefetched images that were used (counted once per image)
+	PrefetchHits int64 `json:"prefetch_hits"`
+}
+
+// entryStats are the statistics of a cache entry
+type entryStats struct {
+	Id        int64   `json:"id"`
+	Sx        int     `json:"sx"`
+	Sy        int     `json:"sy"`
+	Iter      int     `json:"iter"`
+	X0        float64 `json:"x0"`
+	Y0        float64 `json:"y0"`
+	X1        float64 `json:"x1"`
+	Y1        float64 `json:"y1"`
+	Bytes     int64   `json:"bytes"`
+	Hits      int64   `json:"hits"`
+	Age       float64 `json:"age"`
+	Idle      float64 `json:"idle"`
+	Refinable bool    `json:"refinable"`
+}
+
+// cacheStats is a snapshot of the cache statistics
+type cacheStats struct {
+	Entries  []entryStats  `json:"entries"`
+	Bytes    int64         `json:"bytes"`
+	MaxBytes int64         `json:"max_bytes"`
+	Flights  int           `json:"flights"`
+	Counters cacheCounters `json:"counters"`
+	// Statistics of the encoded-images cache, if any
+	Encoded *encStats `json:"encoded,omitempty"`
+}
+
+// claimReq is the claim request structure (send on cache.chClaim)
+type claimReq struct {
+	// Image parameters
+	p *params
+	// Chan to send reply to
+	ch chan bool
+}
+
+// peekReq is the peek request structure (send on cache.chPeek)
+type peekReq struct {
+	// Image parameters
+	p *params
+	// Chan to send reply to
+	ch chan int
+}
+
+// purgeReq is the purge request structure (send on cache.chPurge)
+type purgeReq struct {
+	// Id of the entry to purge. Zero purges all entries
+	id int64
+	// Chan to send the number of purged entries to
+	ch chan int
+}
+
+// cacheKey is the part of the image parameters that identifies an
+// image in the cache.
+type cacheKey struct {
+	Sx, Sy         int
+	Iter           int
+	X0, Y0, X1, Y1 float64
+}
+
+// paramsKey returns the cache key for the image parameters "p".
+func paramsKey(p *params) cacheKey {
+	return cacheKey{
+		Sx: p.Sx, Sy: p.Sy,
+		Iter: p.Iter,
+		X0:   p.X0, Y0: p.Y0, X1: p.X1, Y1: p.Y1,
+	}
+}
+
+// hash returns a hash of the key. Keys of the same image hash to the
+// same value in all instances of the program (it is used to name
+// disk-cache files, and to assign images to peers).
+func (k cacheKey) hash() [sha256.Size]byte {
+	s := fmt.Sprintf("%d %d %d %x %x %x %x", k.Sx, k.Sy, k.Iter,
+		math.Float64bits(k.X0), math.Float64bits(k.Y0),
+		math.Float64bits(k.X1), math.Float64bits(k.Y1))
+	return sha256.Sum256([]byte(s))
+}
+
+// imgKey returns the cache key for image "m".
+func imgKey(m *mandelImg) cacheKey {
+	return cacheKey{
+		Sx: m.Bounds().Dx(), Sy: m.Bounds().Dy(),
+		Iter: m.MaxIter,
+		X0:   real(m.C0), Y0: imag(m.C0),
+		X1: real(m.C1), Y1: imag(m.C1),
+	}
+}
+
+// flight keeps track of the requesters of an image that is being
+// rendered.
+type flight struct {
+	// Reply chan of the requester rendering the image
+	owner chan *mandelImg
+	// Reply chans of the requesters waiting for the image
+	waiters []chan *mandelImg
 }
 
 // lookupReq is the cache-lookup request structure (send on
-// cache.chLookup)
+// cache.chLookup and cache.chCancel)
 type lookupReq struct {
 	// Image parameters
 	p *params
@@ -37,17 +210,113 @@ func (c *cache) match(p *params, m *mandelImg) bool {
 		p.Iter == m.MaxIter
 }
 
-func (c *cache) search(p *params) *mandelImg {
+// find returns the cache element for the image with parameters "p",
+// or nil if the image is not in the cache.
+func (c *cache) find(p *params) *list.Element {
 	for e := c.l.Front(); e != nil; e = e.Next() {
-		ce := e.Value.(*mandelImg)
-		if c.match(p, ce) {
-			return ce
+		ce := e.Value.(*cacheEntry)
+		if c.match(p, ce.img) {
+			return e
 		}
 	}
 	return nil
 }
 
-func (c *cache) add(m *mandelImg) {
+// use marks the cache element "e" as used: moves it to the back of
+// the list, and updates its statistics.
+func (c *cache) use(e *list.Element) {
+	ce := e.Value.(*cacheEntry)
+	ce.used = time.Now()
+	ce.hits++
+	if ce.prefetched && ce.hits == 1 {
+		c.cnt.PrefetchHits++
+	}
+	c.l.MoveToBack(e)
+}
+
+func (c *cache) search(p *params) *mandelImg {
+	e := c.find(p)
+	if e == nil {
+		return nil
+	}
+	c.use(e)
+	return e.Value.(*cacheEntry).img
+}
+
+// covers returns true if the domain of image "m" contains the domain
+// of the image with parameters "p", and "m" has equal or higher pixel
+// density (and the same max iteration count). Only domains with
+// ascending coordinates are considered.
+func (c *cache) covers(p *params, m *mandelImg) bool {
+	// Tolerance, as a fraction of m's pixel size
+	const eps = 1e-6
+	if p.Iter != m.MaxIter || p.X1 <= p.X0 || p.Y1 <= p.Y0 {
+		return false
+	}
+	mx0, mx1 := real(m.C0), real(m.C1)
+	my0, my1 := imag(m.C0), imag(m.C1)
+	if mx1 <= mx0 || my1 <= my0 {
+		return false
+	}
+	mdx := (mx1 - mx0) / float64(m.Bounds().Dx())
+	mdy := (my1 - my0) / float64(m.Bounds().Dy())
+	dx := (p.X1 - p.X0) / float64(p.Sx)
+	dy := (p.Y1 - p.Y0) / float64(p.Sy)
+	return mdx <= dx*(1+eps) && mdy <= dy*(1+eps) &&
+		p.X0 >= mx0-mdx*eps && p.X1 <= mx1+mdx*eps &&
+		p.Y0 >= my0-mdy*eps && p.Y1 <= my1+mdy*eps
+}
+
+// searchCover searches the cache for an image that covers the image
+// with parameters "p" (see covers). If there are more than one, the
+// one with the fewest pixels is returned.
+func (c *cache) searchCover(p *params) *mandelImg {
+	var be *list.Element
+	var bm *mandelImg
+	for e := c.l.Front(); e != nil; e = e.Next() {
+		ce := e.Value.(*cacheEntry).img
+		if !c.covers(p, ce) {
+			continue
+		}
+		if bm == nil || len(ce.pix) < len(bm.pix) {
+			be, bm = e, ce
+		}
+	}
+	if be != nil {
+		c.use(be)
+		c.cnt.CoverHits++
+	}
+	return bm
+}
+
+// searchBase searches the cache for an image that can be refined to
+// produce the image with parameters "p": An image with the same size
+// and domain, with a lower max iteration count, whose final z values
+// are available (see mandelImg.refine). If there are more than one,
+// the one with the highest max iteration count is returned.
+func (c *cache) searchBase(p *params) *mandelImg {
+	var be *list.Element
+	var bm *mandelImg
+	for e := c.l.Front(); e != nil; e = e.Next() {
+		ce := e.Value.(*cacheEntry).img
+		k := imgKey(ce)
+		k.Iter = p.Iter
+		if k != paramsKey(p) || ce.MaxIter >= p.Iter ||
+			ce.zs == nil {
+			continue
+		}
+		if bm == nil || ce.MaxIter > bm.MaxIter {
+			be, bm = e, ce
+		}
+	}
+	if be != nil {
+		c.use(be)
+		c.cnt.BaseHits++
+	}
+	return bm
+}
+
+func (c *cache) add(m *mandelImg, prefetched bool) {
 	p := params{
 		Sx:   m.Bounds().Dx(),
 		Sy:   m.Bounds().Dy(),
@@ -57,13 +326,178 @@ func (c *cache) add(m *mandelImg) {
 		Y1:   imag(m.C1),
 		Iter: m.MaxIter,
 	}
-	if c.search(&p) != nil {
+	if c.find(&p) != nil {
+		return
+	}
+	sz := m.Size()
+	if sz > c.maxBytes {
 		return
 	}
-	if c.l.Len() >= cacheSize {
-		c.l.Remove(c.l.Front())
+	c.lastId++
+	now := time.Now()
+	c.l.PushBack(&cacheEntry{
+		img: m, id: c.lastId, added: now, used: now,
+		prefetched: prefetched})
+	c.bytes += sz
+	c.cnt.Adds++
+	if prefetched {
+		c.cnt.Prefetches++
 	}
-	c.l.PushBack(m)
+	for c.bytes > c.maxBytes {
+		c.remove(c.l.Front())
+		c.cnt.Evictions++
+	}
+}
+
+// remove removes element "e" from the cache
+func (c *cache) remove(e *list.Element) {
+	c.bytes -= e.Value.(*cacheEntry).img.Size()
+	c.l.Remove(e)
+}
+
+// purge removes the entry with the given id (or all entries, if id is
+// zero) from the cache. Returns the number of entries removed.
+func (c *cache) purge(id int64) int {
+	n := 0
+	for e := c.l.Front(); e != nil; {
+		next := e.Next()
+		if id == 0 || e.Value.(*cacheEntry).id == id {
+			c.remove(e)
+			n++
+		}
+		e = next
+	}
+	c.cnt.Purges += int64(n)
+	return n
+}
+
+// stats returns a snapshot of the cache statistics
+func (c *cache) stats() *cacheStats {
+	now := time.Now()
+	st := &cacheStats{
+		Entries:  make([]entryStats, 0, c.l.Len()),
+		Bytes:    c.bytes,
+		MaxBytes: c.maxBytes,
+		Flights:  len(c.flights),
+		Counters: c.cnt,
+	}
+	for e := c.l.Front(); e != nil; e = e.Next() {
+		ce := e.Value.(*cacheEntry)
+		k := imgKey(ce.img)
+		st.Entries = append(st.Entries, entryStats{
+			Id: ce.id,
+			Sx: k.Sx, Sy: k.Sy, Iter: k.Iter,
+			X0: k.X0, Y0: k.Y0, X1: k.X1, Y1: k.Y1,
+			Bytes:     ce.img.Size(),
+			Hits:      ce.hits,
+			Age:       now.Sub(ce.added).Seconds(),
+			Idle:      now.Sub(ce.used).Seconds(),
+			Refinable: ce.img.zs != nil,
+		})
+	}
+	return st
+}
+
+// lookup processes a cache-lookup request. If the image is found, or
+// if there is no flight for it, the reply is sent immediately. In the
+// second case, a flight is started, with the requester as its
+// owner. Otherwise, the requester is added to the flight's waiters.
+func (c *cache) lookup(r lookupReq) {
+	if m := c.search(r.p); m != nil {
+		c.cnt.Hits++
+		r.ch <- m
+		return
+	}
+	k := paramsKey(r.p)
+	f := c.flights[k]
+	if f == nil {
+		c.cnt.Misses++
+		c.flights[k] = &flight{owner: r.ch}
+		r.ch <- nil
+		return
+	}
+	c.cnt.Waits++
+	f.waiters = append(f.waiters, r.ch)
+}
+
+// claim processes a claim request. If the image is neither cached nor
+// being rendered, a flight is started, with the requester as its
+// owner, and the reply is true. Otherwise the reply is false. The
+// cache statistics are not updated.
+func (c *cache) claim(r claimReq) {
+	k := paramsKey(r.p)
+	if c.find(r.p) != nil || c.flights[k] != nil {
+		r.ch <- false
+		return
+	}
+	c.flights[k] = &flight{owner: nil}
+	r.ch <- true
+}
+
+// peek returns the max iteration count up to which the image with
+// parameters "p" is already calculated: p.Iter if the image is cached
+// or being rendered, the max iteration count of the cached image it
+// would be refined from (see searchBase), if any, or zero. The cache
+// statistics, and the order of the entries, are not affected.
+func (c *cache) peek(p *params) int {
+	if c.find(p) != nil || c.flights[paramsKey(p)] != nil {
+		return p.Iter
+	}
+	iter := 0
+	for e := c.l.Front(); e != nil; e = e.Next() {
+		ce := e.Value.(*cacheEntry).img
+		k := imgKey(ce)
+		k.Iter = p.Iter
+		if k == paramsKey(p) && ce.MaxIter < p.Iter &&
+			ce.zs != nil && ce.MaxIter > iter {
+			iter = ce.MaxIter
+		}
+	}
+	return iter
+}
+
+// land completes the flight for image "m" (if any), sending the image
+// to all the flight's waiters.
+func (c *cache) land(m *mandelImg) {
+	k := imgKey(m)
+	f := c.flights[k]
+	if f == nil {
+		return
+	}
+	for _, ch := range f.waiters {
+		ch <- m
+	}
+	delete(c.flights, k)
+}
+
+// cancel processes a cancel-lookup request. If the requester is a
+// waiter, it is removed from the flight's waiters. If it is the
+// flight's owner (or if r.ch is nil) ownership of the flight passes to
+// the first waiter (which is sent a nil reply). If there are no
+// waiters, the flight is dropped.
+func (c *cache) cancel(r lookupReq) {
+	k := paramsKey(r.p)
+	f := c.flights[k]
+	if f == nil {
+		return
+	}
+	if r.ch != nil && r.ch != f.owner {
+		for i, ch := range f.waiters {
+			if ch == r.ch {
+				f.waiters = append(f.waiters[:i],
+					f.waiters[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+	if len(f.waiters) == 0 {
+		delete(c.flights, k)
+		return
+	}
+	f.owner = f.waiters[0]
+	f.waiters = f.waiters[1:]
+	f.owner <- nil
 }
 
 // ReqLookup requests a cache-lookup for an image with the given
@@ -73,37 +507,154 @@ func (c *cache) add(m *mandelImg) {
 // palette than the one specified in the request parameters. Because
 // of this, you must always Repalette images received from the cache
 // to make sure they are rendered with the correct palette.
-func (c *cache) ReqLookup(p *params) *mandelImg {
-	ch := make(chan *mandelImg)
+//
+// Concurrent lookups for the same image are coalesced: If ReqLookup
+// returns nil, the caller becomes responsible for rendering the
+// image, and must call either ReqAdd (with the rendered image), or
+// ReqAbandon (if it fails to render it). Until then, other lookups for
+// the same image wait for the image to be added. If the image is
+// abandoned, one of the waiting lookups returns nil (and its caller
+// becomes responsible for rendering the image). If ctx is done while
+// ReqLookup is waiting, ReqLookup returns nil and ctx.Err().
+func (c *cache) ReqLookup(ctx context.Context,
+	p *params) (*mandelImg, error) {
+	ch := make(chan *mandelImg, 1)
 	r := lookupReq{p, ch}
 	c.chLookup <- r
+	select {
+	case m := <-ch:
+		return m, nil
+	case <-ctx.Done():
+		// Withdraw. If we are (or have just been made) the
+		// owner of the flight, ownership passes to the next
+		// waiter.
+		c.chCancel <- r
+		return nil, ctx.Err()
+	}
+}
+
+// ReqLookupCover requests a cache-lookup for an image that covers the
+// image with the given parameters: an image with the same max
+// iteration count, whose domain contains the domain given in the
+// parameters, at equal or higher pixel density. Such an image can be
+// resampled to produce the requested image. Returns nil if no such
+// image is found. Unlike ReqLookup, ReqLookupCover does not wait for
+// images being rendered. Like with ReqLookup, the returned image must
+// be repaletted.
+func (c *cache) ReqLookupCover(p *params) *mandelImg {
+	ch := make(chan *mandelImg, 1)
+	c.chCover <- lookupReq{p, ch}
 	return <-ch
 }
 
+// ReqLookupBase requests a cache-lookup for an image that can be
+// refined to produce the image with the given parameters (see
+// searchBase and mandelImg.refine). Returns nil if no such image is
+// found. Like ReqLookupCover, it does not wait for images being
+// rendered.
+func (c *cache) ReqLookupBase(p *params) *mandelImg {
+	ch := make(chan *mandelImg, 1)
+	c.chBase <- lookupReq{p, ch}
+	return <-ch
+}
+
+// ReqPeek requests the max iteration count up to which the image with
+// the given parameters is already calculated (see cache.peek). It is
+// used to estimate the cost of rendering the image.
+func (c *cache) ReqPeek(p *params) int {
+	ch := make(chan int, 1)
+	c.chPeek <- peekReq{p, ch}
+	return <-ch
+}
+
+// ReqClaim requests to claim the rendering of the image with the
+// given parameters. Returns true if the image is neither cached nor
+// being rendered; in this case, the caller becomes responsible for
+// rendering the image, exactly as if ReqLookup had returned
+// nil. Otherwise it returns false. Unlike ReqLookup, it never waits,
+// and it does not affect the cache statistics, or the order in which
+// images are evicted. It is used for prefetching.
+func (c *cache) ReqClaim(p *params) bool {
+	ch := make(chan bool, 1)
+	c.chClaim <- claimReq{p, ch}
+	return <-ch
+}
+
+// ReqAbandon notifies the cache that the caller will not render the
+// image with the given parameters, after ReqLookup returned nil. One
+// of the lookups waiting for the image (if any) takes over.
+func (c *cache) ReqAbandon(p *params) {
+	c.chCancel <- lookupReq{p, nil}
+}
+
 // ReqAdd requests that the given image is added to the cache. It is
 // ok to request the addition of an image already in the cache
-// (nothing happens in this case). The oldest cache entry may be
-// evicted as a result of calling ReqAdd (if the cache size has
-// reached cacheSize).
-func (c *cache) ReqAdd(m *mandelImg) {
-	c.chAdd <- m
+// (nothing happens in this case). The least recently used cache
+// entries may be evicted as a result of calling ReqAdd (if the total
+// size of the cached images exceeds the cache's size limit). Images
+// larger than the cache's size limit are not added. Lookups waiting
+// for the image return it. If "prefetched" is true, the image is
+// marked as prefetched (for statistics).
+func (c *cache) ReqAdd(m *mandelImg, prefetched bool) {
+	c.chAdd <- addReq{m, prefetched}
+}
+
+// ReqStats requests a snapshot of the cache statistics.
+func (c *cache) ReqStats() *cacheStats {
+	ch := make(chan *cacheStats)
+	c.chStats <- ch
+	return <-ch
+}
+
+// ReqPurge requests that the entry with the given id (or all entries,
+// if id is zero) is removed from the cache. Returns the number of
+// entries removed.
+func (c *cache) ReqPurge(id int64) int {
+	ch := make(chan int)
+	c.chPurge <- purgeReq{id, ch}
+	return <-ch
 }
 
-// NewCache creates and initializes an image cache and starts the
-// goroutine that receives and processes cache-lookup and cache-add
-// requests. Returns a pointer to the newly created cache.
-func newCache() *cache {
+// NewCache creates and initializes an image cache that keeps images
+// of up to maxBytes total size, and starts the goroutine that
+// receives and processes cache-lookup and cache-add requests. Returns
+// a pointer to the newly created cache.
+func newCache(maxBytes int64) *cache {
 	c := new(cache)
 	c.l = list.New()
+	c.maxBytes = maxBytes
+	c.flights = make(map[cacheKey]*flight)
 	c.chLookup = make(chan lookupReq)
-	c.chAdd = make(chan *mandelImg)
+	c.chCancel = make(chan lookupReq)
+	c.chCover = make(chan lookupReq)
+	c.chBase = make(chan lookupReq)
+	c.chClaim = make(chan claimReq)
+	c.chPeek = make(chan peekReq)
+	c.chStats = make(chan chan *cacheStats)
+	c.chPurge = make(chan purgeReq)
+	c.chAdd = make(chan addReq)
 	go func(c *cache) {
 		for {
 			select {
 			case lup := <-c.chLookup:
-				lup.ch <- c.search(lup.p)
-			case img := <-c.chAdd:
-				c.add(img)
+				c.lookup(lup)
+			case lup := <-c.chCancel:
+				c.cancel(lup)
+			case lup := <-c.chCover:
+				lup.ch <- c.searchCover(lup.p)
+			case lup := <-c.chBase:
+				lup.ch <- c.searchBase(lup.p)
+			case cr := <-c.chClaim:
+				c.claim(cr)
+			case pr := <-c.chPeek:
+				pr.ch <- c.peek(pr.p)
+			case ch := <-c.chStats:
+				ch <- c.stats()
+			case pr := <-c.chPurge:
+				pr.ch <- c.purge(pr.id)
+			case ar := <-c.chAdd:
+				c.add(ar.img, ar.prefetched)
+				c.land(ar.img)
 			}
 		}
 	}(c)
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCacheLRU(t *testing.T) {
+	var imgs []*mandelImg
+	for i := 0; i < 4; i++ {
+		m, err := newMandelImg(context.Background(), 32, 32, pal256Gray,
+			complex(-2.0, -1.2), complex(1.0, 1.2), 16+i, 2, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		imgs = append(imgs, m)
+	}
+	// Room for 3 images
+	c := newCache(3*imgs[3].Size() + imgs[3].Size()/2)
+	p := func(m *mandelImg) *params {
+		return &params{Sx: 32, Sy: 32, Iter: m.MaxIter,
+			X0: -2.0, Y0: -1.2, X1: 1.0, Y1: 1.2}
+	}
+	c.add(imgs[0], false)
+	c.add(imgs[1], false)
+	c.add(imgs[2], false)
+	// Use imgs[0], so that imgs[1] is evicted, instead
+	if c.search(p(imgs[0])) != imgs[0] {
+		t.Fatal("imgs[0] not found")
+	}
+	c.add(imgs[3], false)
+	if c.search(p(imgs[1])) != nil {
+		t.Fatal("imgs[1] not evicted")
+	}
+	for _, i := range []int{0, 2, 3} {
+		if c.search(p(imgs[i])) != imgs[i] {
+			t.Fatalf("imgs[%d] not found", i)
+		}
+	}
+	if c.bytes > c.maxBytes {
+		t.Fatalf("bytes = %d > maxBytes = %d", c.bytes, c.maxBytes)
+	}
+	// Too large for the cache
+	c = newCache(imgs[0].Size() - 1)
+	c.add(imgs[0], false)
+	if c.l.Len() != 0 || c.bytes != 0 {
+		t.Fatal("too-large image added")
+	}
+}
+
+func TestCacheFlight(t *testing.T) {
+	m, err := newMandelImg(context.Background(), 32, 32, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 16, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &params{Sx: 32, Sy: 32, Iter: 16,
+		X0: -2.0, Y0: -1.2, X1: 1.0, Y1: 1.2}
+	c := newCache(1 << 20)
+	bg := context.Background()
+	// First lookup owns the flight
+	if m, _ := c.ReqLookup(bg, p); m != nil {
+		t.Fatal("image found in empty cache")
+	}
+	// Following lookups wait
+	ch := make(chan *mandelImg)
+	for i := 0; i < 3; i++ {
+		go func() {
+			m, _ := c.ReqLookup(bg, p)
+			ch <- m
+		}()
+	}
+	// A waiter that gives up
+	ctx, cancel := context.WithCancel(bg)
+	errc := make(chan error)
+	go func() {
+		_, err := c.ReqLookup(ctx, p)
+		errc <- err
+	}()
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("err = %v", err)
+	}
+	// Abandon: One of the waiters takes over
+	c.ReqAbandon(p)
+	if m := <-ch; m != nil {
+		t.Fatal("waiter got image, not ownership")
+	}
+	c.ReqAdd(m, false)
+	for i := 0; i < 2; i++ {
+		if mw := <-ch; mw != m {
+			t.Fatal("waiter did not get image")
+		}
+	}
+	if mc, _ := c.ReqLookup(bg, p); mc != m {
+		t.Fatal("image not cached")
+	}
+}
+
+func TestCacheCover(t *testing.T) {
+	m, err := newMandelImg(context.Background(), 320, 256, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 32, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCache(1 << 30)
+	c.add(m, false)
+	var tests = []struct {
+		p     params
+		cover bool
+	}{
+		// Exact
+		{params{Sx: 320, Sy: 256, Iter: 32,
+			X0: -2.0, Y0: -1.2, X1: 1.0, Y1: 1.2}, true},
+		// Resize
+		{params{Sx: 160, Sy: 128, Iter: 32,
+			X0: -2.0, Y0: -1.2, X1: 1.0, Y1: 1.2}, true},
+		// Sub-region, same density
+		{params{Sx: 160, Sy: 128, Iter: 32,
+			X0: -1.0, Y0: -0.6, X1: 0.5, Y1: 0.6}, true},
+		// Sub-region, higher density
+		{params{Sx: 320, Sy: 256, Iter: 32,
+			X0: -1.0, Y0: -0.6, X1: 0.5, Y1: 0.6}, false},
+		// Outside
+		{params{Sx: 160, Sy: 128, Iter: 32,
+			X0: -2.5, Y0: -1.2, X1: 1.0, Y1: 1.2}, false},
+		// Different max iteration count
+		{params{Sx: 160, Sy: 128, Iter: 64,
+			X0: -2.0, Y0: -1.2, X1: 1.0, Y1: 1.2}, false},
+	}
+	for i, tt := range tests {
+		if (c.searchCover(&tt.p) != nil) != tt.cover {
+			t.Fatalf("%d: cover != %v", i, tt.cover)
+		}
+	}
+	// Resampling a pixel-aligned sub-region at the same density
+	// must reproduce the pixels
+	mr := m.resample(160, 128, complex(-1.25, -0.6), complex(0.25, 0.6))
+	mc, err := newMandelImg(context.Background(), 160, 128, pal256Gray,
+		complex(-1.25, -0.6), complex(0.25, 0.6), 32, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := 0
+	for i := range mc.pix {
+		if mr.pix[i] != mc.pix[i] {
+			diff++
+		}
+	}
+	// Allow for rounding at the edges of pixels
+	if diff > len(mc.pix)/100 {
+		t.Fatalf("%d pixels differ", diff)
+	}
+}
+
+func TestCacheBase(t *testing.T) {
+	c := newCache(1 << 30)
+	for _, iter := range []int{16, 32, 128} {
+		m, err := newMandelImg(context.Background(), 32, 32, pal256Gray,
+			complex(-2.0, -1.2), complex(1.0, 1.2), iter, 2, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.add(m, false)
+	}
+	p := &params{Sx: 32, Sy: 32, Iter: 64,
+		X0: -2.0, Y0: -1.2, X1: 1.0, Y1: 1.2}
+	if m := c.searchBase(p); m == nil || m.MaxIter != 32 {
+		t.Fatal("base image not found")
+	}
+	p.Iter = 16
+	if m := c.searchBase(p); m != nil {
+		t.Fatal("base image found for lowest iteration count")
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	c := newCache(1 << 30)
+	p := &params{Sx: 32, Sy: 32, Iter: 16,
+		X0: -2.0, Y0: -1.2, X1: 1.0, Y1: 1.2}
+	bg := context.Background()
+	m, _ := c.ReqLookup(bg, p)
+	if m != nil {
+		t.Fatal("image found in empty cache")
+	}
+	m, err := newMandelImg(context.Background(), 32, 32, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 16, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ReqAdd(m, false)
+	c.ReqLookup(bg, p)
+	c.ReqLookup(bg, p)
+	st := c.ReqStats()
+	if st.Counters.Hits != 2 || st.Counters.Misses != 1 ||
+		st.Counters.Adds != 1 {
+		t.Fatalf("bad counters: %+v", st.Counters)
+	}
+	if len(st.Entries) != 1 || st.Entries[0].Hits != 2 ||
+		st.Entries[0].Bytes != m.Size() || st.Bytes != m.Size() {
+		t.Fatalf("bad entries: %+v", st.Entries)
+	}
+	if n := c.ReqPurge(st.Entries[0].Id + 1); n != 0 {
+		t.Fatalf("purged %d entries", n)
+	}
+	if n := c.ReqPurge(st.Entries[0].Id); n != 1 {
+		t.Fatalf("purged %d entries", n)
+	}
+	if st := c.ReqStats(); len(st.Entries) != 0 || st.Bytes != 0 {
+		t.Fatalf("bad stats after purge: %+v", st)
+	}
+}
+
+func TestEncCache(t *testing.T) {
+	c := newEncCache(10)
+	if c.ReqLookup("a") != nil {
+		t.Fatal("entry found in empty cache")
+	}
+	c.ReqAdd("a", []byte("aaaa"))
+	c.ReqAdd("b", []byte("bbbb"))
+	if string(c.ReqLookup("a")) != "aaaa" {
+		t.Fatal("entry a not found")
+	}
+	// Evicts b (least recently used)
+	c.ReqAdd("c", []byte("cccc"))
+	if c.ReqLookup("b") != nil {
+		t.Fatal("entry b not evicted")
+	}
+	// Too large
+	c.ReqAdd("d", []byte("ddddddddddd"))
+	if c.ReqLookup("d") != nil {
+		t.Fatal("too-large entry added")
+	}
+	st := c.ReqStats()
+	if st.Entries != 2 || st.Bytes != 8 || st.Counters.Hits != 1 ||
+		st.Counters.Misses != 3 || st.Counters.Evictions != 1 {
+		t.Fatalf("bad stats: %+v", st)
+	}
+	if n := c.ReqPurge(); n != 2 {
+		t.Fatalf("purged %d entries", n)
+	}
+}
+
+func TestNeighbors(t *testing.T) {
+	p := &params{Sx: 640, Sy: 512, Iter: 64,
+		X0: -1.0, Y0: -0.5, X1: -0.5, Y1: 0.0}
+	ns := neighbors(p)
+	if len(ns) != 6 {
+		t.Fatalf("len(ns) = %d", len(ns))
+	}
+	if ns[0].X0 != -0.875 || ns[0].X1 != -0.625 {
+		t.Fatalf("bad zoom-in: %+v", ns[0])
+	}
+	// Zoom-out and pans outside the function domain are omitted
+	p = &params{Sx: 640, Sy: 512, Iter: 64,
+		X0: minX, Y0: minY, X1: maxX, Y1: maxY}
+	if ns := neighbors(p); len(ns) != 1 {
+		t.Fatalf("len(ns) = %d", len(ns))
+	}
+}
+
+func TestCacheClaim(t *testing.T) {
+	c := newCache(1 << 30)
+	p := &params{Sx: 32, Sy: 32, Iter: 16,
+		X0: -2.0, Y0: -1.2, X1: 1.0, Y1: 1.2}
+	if !c.ReqClaim(p) {
+		t.Fatal("claim failed on empty cache")
+	}
+	if c.ReqClaim(p) {
+		t.Fatal("claim succeeded for image being rendered")
+	}
+	m, err := newMandelImg(context.Background(), 32, 32, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 16, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ReqAdd(m, true)
+	if c.ReqClaim(p) {
+		t.Fatal("claim succeeded for cached image")
+	}
+	st := c.ReqStats()
+	if st.Counters.Prefetches != 1 || st.Counters.PrefetchHits != 0 {
+		t.Fatalf("bad counters: %+v", st.Counters)
+	}
+	c.ReqLookup(context.Background(), p)
+	c.ReqLookup(context.Background(), p)
+	if st := c.ReqStats(); st.Counters.PrefetchHits != 1 {
+		t.Fatalf("bad counters: %+v", st.Counters)
+	}
+}
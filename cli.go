@@ -0,0 +1,325 @@
+// Command-line rendering (the render and batch subcommands)
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// imgFlags are the image parameters that can be given as flags to the
+// render subcommand. They are the parameters of /mandel (see
+// getParams), and are validated the same way.
+var imgFlags = []struct {
+	name, usage string
+	isBool      bool
+}{
+	{"sx", "Image width (pixels)", false},
+	{"sy", "Image height (pixels)", false},
+	{"iter", "Max number of iterations per pixel", false},
+	{"x0", "Real part of the domain's lower bound", false},
+	{"y0", "Imaginary part of the domain's lower bound", false},
+	{"x1", "Real part of the domain's upper bound", false},
+	{"y1", "Imaginary part of the domain's upper bound", false},
+	{"pal", "Palette name", false},
+	{"cpal", "Custom palette specification", false},
+	{"poff", "Palette offset (fraction of palette length)", false},
+	{"prep", "Palette repeat count", false},
+	{"prev", "Traverse the palette in reverse", true},
+	{"pgam", "Palette gamma", false},
+	{"map", "Iteration-count mapping function", false},
+	{"con", "Contrast (for the Rank mapping function)", false},
+}
+
+// paramFlag is a flag.Value that stores the flag's value as URL
+// query parameter "name" in "v".
+type paramFlag struct {
+	v      url.Values
+	name   string
+	isBool bool
+}
+
+func (f *paramFlag) String() string {
+	if f.v == nil {
+		return ""
+	}
+	return f.v.Get(f.name)
+}
+
+func (f *paramFlag) Set(s string) error {
+	f.v.Set(f.name, s)
+	return nil
+}
+
+func (f *paramFlag) IsBoolFlag() bool { return f.isBool }
+
+// cmdFlags returns the flag set for subcommand "cmd", with the global
+// flags that apply to rendering (cache and validation flags). Usage
+// is "usage", following the subcommand's name.
+func cmdFlags(cmd, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	for _, n := range []string{"cache-mem", "cache-dir", "cache-disk",
+		"strict", "render-timeout"} {
+		f := flag.Lookup(n)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage is: %s %s %s\n",
+			path.Base(os.Args[0]), cmd, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// initCaches creates the caches of rendered images, according to the
+// cache flags.
+func initCaches() error {
+	imgCache = newCache(*cacheMem * 1024 * 1024)
+	encImgCache = newEncCache(*cacheEnc * 1024 * 1024)
+	if *cacheDir != "" {
+		var err error
+		imgDisk, err = newDiskCache(*cacheDir, *cacheDisk*1024*1024)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitCaches waits for the images being stored in the on-disk cache
+// (if any) to be stored. Subcommands must call it before exiting.
+func waitCaches() {
+	if imgDisk != nil {
+		imgDisk.wait()
+	}
+}
+
+// valuesParams returns the image parameters given as the URL query
+// parameters "v", parsed and validated like the parameters of
+// requests (see getParams).
+func valuesParams(v url.Values) *params {
+	return getParams(&http.Request{Form: v, Header: http.Header{}})
+}
+
+// outFormat returns the format of output file "out": "format", if not
+// empty, or else the file's extension. Returns non-nil error if the
+// format is not supported.
+func outFormat(out, format string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(out), ".")
+		if format == "" || out == "-" {
+			format = "png"
+		}
+	}
+	switch strings.ToLower(format) {
+	case "png":
+		return "png", nil
+	case "gif":
+		return "gif", nil
+	case "jpg", "jpeg":
+		return "jpg", nil
+	}
+	return "", fmt.Errorf("Unsupported format %q", format)
+}
+
+// renderFile renders the image with parameters "p" and writes it to
+// file "out" ("-": standard output), in format "format" (see
+// outFormat). Images are rendered through the caches (see getImg).
+func renderFile(ctx context.Context, p *params, out, format string) error {
+	format, err := outFormat(out, format)
+	if err != nil {
+		return err
+	}
+	img, err := getImg(ctx, p)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		pi, perr := img.Paletted()
+		if perr != nil {
+			err = gif.Encode(&buf, img, nil)
+		} else {
+			err = gif.Encode(&buf, pi, nil)
+		}
+	case "jpg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		return err
+	}
+	if out == "-" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return os.WriteFile(out, buf.Bytes(), 0666)
+}
+
+// reportErrors prints the parameter errors "fe" to standard error,
+// prefixed by "pref". Returns non-nil error if there are errors, and
+// "strict" is true.
+func reportErrors(pref string, fe fieldErrors, strict bool) error {
+	for _, e := range fe {
+		fmt.Fprintf(os.Stderr, "%s%s: %s\n", pref, e.Field, e.Error)
+	}
+	if strict && fe != nil {
+		return errors.New("Invalid parameters")
+	}
+	return nil
+}
+
+// renderCmd implements the render subcommand: It renders the image
+// with the parameters given as flags, and writes it to a file.
+func renderCmd(args []string) int {
+	fs := cmdFlags("render", "[flags]")
+	v := url.Values{}
+	for _, f := range imgFlags {
+		fs.Var(&paramFlag{v, f.name, f.isBool}, f.name, f.usage)
+	}
+	out := fs.String("o", "mandel.png",
+		"Output file (\"-\": standard output)")
+	format := fs.String("format", "",
+		"Output format: png, gif, or jpg (default: from the "+
+			"output file's extension, or png)")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	if err := initCaches(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	p := valuesParams(v)
+	if err := reportErrors("-", p.Errors, p.Strict); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err := renderFile(context.Background(), p, *out, *format)
+	waitCaches()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// batchCmd implements the batch subcommand: It renders the images
+// specified in a file ("-": standard input), one per line. Every line
+// is a URL query string with the image parameters (as for /mandel),
+// and optionally the output file ("out"; default "mandel-<n>.png",
+// for the n-th image) and format ("format"). Empty lines and lines
+// starting with "#" are ignored. Images that fail are reported, and
+// the rest are rendered.
+func batchCmd(args []string) int {
+	fs := cmdFlags("batch", "[flags] <spec file>")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if err := initCaches(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	name := fs.Arg(0)
+	var in io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	err := runBatch(context.Background(), in, name)
+	waitCaches()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runBatch renders the images specified in "in" (see batchCmd).
+// Errors are reported prefixed by "name" and the line number. Returns
+// non-nil error if any image failed.
+func runBatch(ctx context.Context, in io.Reader, name string) error {
+	known := map[string]bool{"out": true, "format": true, "strict": true}
+	for _, f := range imgFlags {
+		known[f.name] = true
+	}
+	sc := bufio.NewScanner(in)
+	n, failed := 0, 0
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || s[0] == '#' {
+			continue
+		}
+		n++
+		pref := fmt.Sprintf("%s:%d: ", name, line)
+		fail := func(err error) {
+			fmt.Fprintf(os.Stderr, "%s%v\n", pref, err)
+			failed++
+		}
+		v, err := url.ParseQuery(s)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		p := valuesParams(v)
+		for k := range v {
+			if !known[k] {
+				p.Errors.add(k, "unknown parameter; ignored")
+			}
+		}
+		if err := reportErrors(pref, p.Errors, p.Strict); err != nil {
+			fail(err)
+			continue
+		}
+		format := v.Get("format")
+		out := v.Get("out")
+		if out == "" {
+			f, err := outFormat("", format)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			out = fmt.Sprintf("mandel-%d.%s", n, f)
+		}
+		start := time.Now()
+		if err := renderFile(ctx, p, out, format); err != nil {
+			fail(err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s%s (%dx%d, %d iterations) %v\n",
+			pref, out, p.Sx, p.Sy, p.Iter,
+			time.Since(start).Round(time.Millisecond))
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed", failed, n)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutFormat(t *testing.T) {
+	tests := []struct {
+		out, format, want string
+	}{
+		{"a.png", "", "png"},
+		{"a.GIF", "", "gif"},
+		{"a.jpeg", "", "jpg"},
+		{"a", "", "png"},
+		{"-", "", "png"},
+		{"a.png", "jpg", "jpg"},
+		{"a.bmp", "", ""},
+		{"a.png", "tiff", ""},
+	}
+	for _, tc := range tests {
+		f, err := outFormat(tc.out, tc.format)
+		if f != tc.want || (err != nil) != (tc.want == "") {
+			t.Errorf("%s, %s: %s, %v", tc.out, tc.format, f, err)
+		}
+	}
+}
+
+func TestRenderCmd(t *testing.T) {
+	saved, savedEnc := imgCache, encImgCache
+	defer func() { imgCache, encImgCache = saved, savedEnc }()
+	out := filepath.Join(t.TempDir(), "m.gif")
+	rc := renderCmd([]string{"-sx", "400", "-sy", "300", "-iter", "32",
+		"-pal", "Gold 1", "-prev", "-o", out})
+	if rc != 0 {
+		t.Fatalf("exit status %d", rc)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := gif.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 400 || b.Dy() != 300 {
+		t.Errorf("size %v", b)
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	saved := imgCache
+	defer func() { imgCache = saved }()
+	imgCache = newCache(1 << 30)
+	dir := t.TempDir()
+	spec := strings.Join([]string{
+		"# Comment",
+		"sx=320&sy=256&iter=32&out=" + filepath.Join(dir, "a.png"),
+		"",
+		"sx=320&sy=256&iter=64&pal=Gold+1&out=" +
+			filepath.Join(dir, "b.png"),
+		"sx=320&sy=256&out=" + filepath.Join(dir, "c.bmp"),
+		"sx=10&sy=256&strict=1&out=" + filepath.Join(dir, "d.png"),
+		"sx=320&sy=256&bogus=1&out=" + filepath.Join(dir, "e.png"),
+	}, "\n")
+	err := runBatch(context.Background(), strings.NewReader(spec), "spec")
+	if err == nil || err.Error() != "2 of 5 images failed" {
+		t.Errorf("error: %v", err)
+	}
+	for _, n := range []string{"a.png", "b.png", "e.png"} {
+		f, err := os.Open(filepath.Join(dir, n))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", n, err)
+			continue
+		}
+		if b := img.Bounds(); b.Dx() != 320 || b.Dy() != 256 {
+			t.Errorf("%s: size %v", n, b)
+		}
+	}
+	for _, n := range []string{"c.bmp", "d.png"} {
+		if _, err := os.Stat(filepath.Join(dir, n)); err == nil {
+			t.Errorf("%s: written", n)
+		}
+	}
+}
+
+func TestRenderCmdDiskCache(t *testing.T) {
+	saved, savedEnc, savedDisk := imgCache, encImgCache, imgDisk
+	savedDir := *cacheDir
+	defer func() {
+		imgCache, encImgCache, imgDisk = saved, savedEnc, savedDisk
+		*cacheDir = savedDir
+	}()
+	dir := t.TempDir()
+	cdir := filepath.Join(dir, "cache")
+	rc := renderCmd([]string{"-cache-dir", cdir, "-sx", "320", "-sy", "256",
+		"-iter", "32", "-o", filepath.Join(dir, "m.png")})
+	if rc != 0 {
+		t.Fatalf("exit status %d", rc)
+	}
+	// The image is stored when renderCmd returns
+	fns, _ := filepath.Glob(filepath.Join(cdir, "*"))
+	if len(fns) != 1 || filepath.Ext(fns[0]) != diskExt {
+		t.Fatalf("cache files: %v", fns)
+	}
+}
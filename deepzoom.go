@@ -0,0 +1,178 @@
+// Deep Zoom (DZI) images
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Size (in pixels) of the virtual images served by the Deep
+	// Zoom and IIIF endpoints
+	maxDeepSize = 1 << 26
+	dflDeepSx   = 1 << 16
+	// Deep Zoom tile size (tiles do not overlap)
+	dziTileSize = 256
+)
+
+// deepParams returns the parameters of the virtual image identified
+// by "id", for the Deep Zoom and IIIF endpoints. The identifier is a
+// URL query string with the image parameters (see getParams), e.g.
+// "sx=65536&x0=-1&x1=0.5". Missing (or unknown) parameters take their
+// default values, so any identifier without parameters (e.g.
+// "mandel") is the default image. The image size ("sx", "sy") may be
+// up to maxDeepSize; if "sy" is missing, it is set from "sx" and the
+// domain's aspect ratio. If the "map" parameter is missing, the
+// default mapping function for tiles is used (see dflTileMap). Other
+// parameters (and session cookies) are taken from request "r".
+func deepParams(r *http.Request, id string) *params {
+	v, _ := url.ParseQuery(id)
+	rv := *r
+	rv.Form = v
+	p := getParams(&rv)
+	// Drop errors for the parameters parsed again below
+	var fe fieldErrors
+	for _, e := range p.Errors {
+		if e.Field != "sx" && e.Field != "sy" {
+			fe = append(fe, e)
+		}
+	}
+	p.Errors = fe
+	p.Sx = valInt(&p.Errors, &rv, "sx", 1, maxDeepSize, dflDeepSx)
+	dflSy := int(float64(p.Sx)*(p.Y1-p.Y0)/(p.X1-p.X0) + 0.5)
+	if dflSy < 1 {
+		dflSy = 1
+	} else if dflSy > maxDeepSize {
+		dflSy = maxDeepSize
+	}
+	p.Sy = valInt(&p.Errors, &rv, "sy", 1, maxDeepSize, dflSy)
+	if v.Get("map") == "" {
+		p.Map = dflTileMap
+	}
+	return p
+}
+
+// regionParams returns the parameters of the image of the region
+// (rx, ry, rw, rh) (in pixels) of the virtual image with parameters
+// "p", scaled to w x h pixels.
+func regionParams(p *params, rx, ry, rw, rh, w, h int) *params {
+	q := *p
+	dx := (p.X1 - p.X0) / float64(p.Sx)
+	dy := (p.Y1 - p.Y0) / float64(p.Sy)
+	q.X0 = p.X0 + float64(rx)*dx
+	q.X1 = p.X0 + float64(rx+rw)*dx
+	q.Y0 = p.Y0 + float64(ry)*dy
+	q.Y1 = p.Y0 + float64(ry+rh)*dy
+	q.Sx, q.Sy = w, h
+	q.Errors = nil
+	return &q
+}
+
+// dziMaxLevel returns the highest Deep Zoom level of a w x h image.
+// At this level the image has its full size; at every level below it
+// is scaled down by two, down to level zero (1 x 1 pixels).
+func dziMaxLevel(w, h int) int {
+	n := w
+	if h > n {
+		n = h
+	}
+	l := 0
+	for 1<<uint(l) < n {
+		l++
+	}
+	return l
+}
+
+// dziTile returns the parameters of the tile at column "col" and row
+// "row" of Deep Zoom level "level", of the virtual image with
+// parameters "p". Returns nil if there is no such tile.
+func dziTile(p *params, level, col, row int) *params {
+	ml := dziMaxLevel(p.Sx, p.Sy)
+	if level < 0 || level > ml || col < 0 || row < 0 {
+		return nil
+	}
+	// Level size, and its scale factor
+	sc := 1 << uint(ml-level)
+	lw, lh := (p.Sx+sc-1)/sc, (p.Sy+sc-1)/sc
+	x, y := col*dziTileSize, row*dziTileSize
+	if x >= lw || y >= lh {
+		return nil
+	}
+	w, h := dziTileSize, dziTileSize
+	if x+w > lw {
+		w = lw - x
+	}
+	if y+h > lh {
+		h = lh - y
+	}
+	// Region in full-size pixels
+	rx, ry := x*sc, y*sc
+	rw, rh := w*sc, h*sc
+	if rx+rw > p.Sx {
+		rw = p.Sx - rx
+	}
+	if ry+rh > p.Sy {
+		rh = p.Sy - ry
+	}
+	return regionParams(p, rx, ry, rw, rh, w, h)
+}
+
+// dziHandler serves Deep Zoom images: The image descriptor at
+// /dzi/<id>.dzi, and the tiles at /dzi/<id>_files/<level>/<col>_<row>.png.
+// The identifier <id> specifies the image (see deepParams).
+func dziHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/dzi/")
+	if strings.HasSuffix(path, ".dzi") {
+		p := deepParams(r, strings.TrimSuffix(path, ".dzi"))
+		if p.Strict && p.Errors != nil {
+			paramsError(w, r, p.Errors)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008"
+  Format="png" Overlap="0" TileSize="%d">
+  <Size Width="%d" Height="%d"/>
+</Image>
+`, dziTileSize, p.Sx, p.Sy)
+		return
+	}
+	i := strings.LastIndex(path, "_files/")
+	if i < 0 || !strings.HasSuffix(path, ".png") {
+		http.NotFound(w, r)
+		return
+	}
+	p := deepParams(r, path[:i])
+	if p.Strict && p.Errors != nil {
+		paramsError(w, r, p.Errors)
+		return
+	}
+	// Parse "<level>/<col>_<row>.png"
+	var f []string
+	lt := strings.Split(strings.TrimSuffix(path[i+7:], ".png"), "/")
+	if len(lt) == 2 {
+		f = append([]string{lt[0]}, strings.Split(lt[1], "_")...)
+	}
+	var v [3]int
+	ok := len(f) == 3
+	for j := 0; ok && j < 3; j++ {
+		var err error
+		v[j], err = strconv.Atoi(f[j])
+		ok = err == nil
+	}
+	var q *params
+	if ok {
+		q = dziTile(p, v[0], v[1], v[2])
+	}
+	if q == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	serveImg(w, r, q, false, false)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeepParams(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	p := deepParams(r, "sx=100000&x0=-1&x1=0.5&y0=-0.6&y1=0.6")
+	if p.Errors != nil {
+		t.Errorf("errors: %v", p.Errors)
+	}
+	if p.Sx != 100000 || p.Sy != 80000 || p.Map != dflTileMap {
+		t.Errorf("size %dx%d, map %s", p.Sx, p.Sy, p.Map)
+	}
+	p = deepParams(r, "mandel")
+	if p.Errors != nil || p.Sx != dflDeepSx || p.X0 != dflX0 {
+		t.Errorf("default: errors %v, size %d, x0 %g",
+			p.Errors, p.Sx, p.X0)
+	}
+	p = deepParams(r, "sx=0&sy=1000000000")
+	if len(p.Errors) != 2 || p.Sx != 1 || p.Sy != maxDeepSize {
+		t.Errorf("errors %v, size %dx%d", p.Errors, p.Sx, p.Sy)
+	}
+}
+
+func TestDZITile(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	p := deepParams(r, "sx=1000&sy=600")
+	if ml := dziMaxLevel(p.Sx, p.Sy); ml != 10 {
+		t.Fatalf("max level %d", ml)
+	}
+	tests := []struct {
+		level, col, row int
+		w, h            int
+	}{
+		{10, 0, 0, 256, 256},
+		{10, 3, 2, 232, 88},
+		{9, 1, 1, 244, 44},
+		{1, 0, 0, 2, 2},
+		{0, 0, 0, 1, 1},
+		{10, 4, 0, 0, 0},
+		{11, 0, 0, 0, 0},
+		{-1, 0, 0, 0, 0},
+	}
+	for _, tc := range tests {
+		q := dziTile(p, tc.level, tc.col, tc.row)
+		if q == nil {
+			if tc.w != 0 {
+				t.Errorf("%d/%d_%d: no tile", tc.level, tc.col, tc.row)
+			}
+			continue
+		}
+		if q.Sx != tc.w || q.Sy != tc.h {
+			t.Errorf("%d/%d_%d: size %dx%d, want %dx%d",
+				tc.level, tc.col, tc.row, q.Sx, q.Sy, tc.w, tc.h)
+		}
+	}
+	// The last tile ends at the image's edge
+	q := dziTile(p, 10, 3, 2)
+	if q.X1 != p.X1 || q.Y1 != p.Y1 {
+		t.Errorf("last tile domain ends at %g,%g", q.X1, q.Y1)
+	}
+}
+
+func TestDZIHandler(t *testing.T) {
+	saved, savedEnc := imgCache, encImgCache
+	defer func() { imgCache, encImgCache = saved, savedEnc }()
+	imgCache = newCache(1 << 30)
+	encImgCache = newEncCache(1 << 20)
+	w := httptest.NewRecorder()
+	dziHandler(w, httptest.NewRequest("GET", "/dzi/sx=1000&sy=600.dzi", nil))
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), `Width="1000" Height="600"`) {
+		t.Errorf("descriptor: status %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	dziHandler(w, httptest.NewRequest("GET",
+		"/dzi/sx=1000&sy=600_files/10/3_2.png", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("tile: status %d: %s", w.Code, w.Body)
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 232 || b.Dy() != 88 {
+		t.Errorf("tile size %v", b)
+	}
+	for _, path := range []string{
+		"/dzi/sx=1000&sy=600_files/10/4_0.png",
+		"/dzi/sx=1000&sy=600_files/10/3/2.png",
+		"/dzi/sx=1000&sy=600_files/10_3_2.png",
+		"/dzi/sx=1000&sy=600_files/10/3_2.jpg",
+		"/dzi/sx=1000&sy=600",
+	} {
+		w = httptest.NewRecorder()
+		dziHandler(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+// Persistent (on-disk) cache of rendered images
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Disk-cache file-format magic and version
+	diskMagic   = "MNDL"
+	diskVersion = 2
+	// Extension of disk-cache files
+	diskExt = ".mdc"
+	// Number of values read / written at once
+	diskChunk = 64 * 1024
+	// Prefix of temporary files (files being written)
+	diskTmp = "tmp-"
+	// Temporary files older than this are left over by writes that
+	// did not complete (e.g. the process was killed), and are
+	// removed
+	diskTmpAge = time.Hour
+)
+
+// diskHdr is the header of disk-cache files. It is followed by the
+// gzip-compressed image data: The pix array, followed by the histo
+// array, as little-endian uint32 values, followed by the final z
+// values of the non-escaped pixels (the zs array) as pairs of
+// little-endian float64 values.
+type diskHdr struct {
+	Magic          [4]byte
+	Version        uint32
+	W, H           uint32
+	MaxIter        uint32
+	X0, Y0, X1, Y1 float64
+	Radius         float64
+}
+
+// diskCache is a cache of rendered images, kept as files in a
+// directory. Files are named after a hash of the image parameters. It
+// is safe for concurrent use.
+type diskCache struct {
+	// Directory where files are kept
+	dir string
+	// Max total size of files (in bytes)
+	maxBytes int64
+	// Serializes evictions
+	mu sync.Mutex
+	// Stores in progress (see storeAsync)
+	pending sync.WaitGroup
+}
+
+// newDiskCache creates a disk cache that keeps up to maxBytes of
+// files in directory "dir". The directory is created, if it does not
+// exist. Stale temporary files, and the least recently used files
+// over the size limit, are removed (see evict).
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	d := &diskCache{dir: dir, maxBytes: maxBytes}
+	if err := d.evict(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// path returns the path of the file for images with key "k".
+func (d *diskCache) path(k cacheKey) string {
+	h := k.hash()
+	return filepath.Join(d.dir, hex.EncodeToString(h[:])+diskExt)
+}
+
+// load loads the image with key "k" from the cache. Returns nil if
+// the image is not in the cache, or if its file is invalid (in which
+// case the file is removed). On success, the file's modification time
+// is updated (files are evicted in least-recently-used order).
+func (d *diskCache) load(k cacheKey) *mandelImg {
+	fn := d.path(k)
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil
+	}
+	m, err := readImg(bufio.NewReader(f))
+	f.Close()
+	if err != nil || imgKey(m) != k {
+		os.Remove(fn)
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(fn, now, now)
+	return m
+}
+
+// store stores image "m" in the cache, then evicts the least
+// recently used files, if the total size of the files exceeds the
+// cache's size limit.
+func (d *diskCache) store(m *mandelImg) error {
+	f, err := os.CreateTemp(d.dir, diskTmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = m.writeTo(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), d.path(imgKey(m)))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return d.evict()
+}
+
+// storeAsync stores image "m" in the cache (see store) in the
+// background. Failures are logged. See also wait.
+func (d *diskCache) storeAsync(m *mandelImg) {
+	d.pending.Add(1)
+	go func() {
+		defer d.pending.Done()
+		if err := d.store(m); err != nil {
+			log.Printf("Disk cache: %v", err)
+		}
+	}()
+}
+
+// wait waits for the stores started by storeAsync to complete. Must
+// be called before the program exits, so that images are not lost,
+// and no temporary files are left behind.
+func (d *diskCache) wait() {
+	d.pending.Wait()
+}
+
+// evict removes the least recently used files, until the total size
+// of the files in the cache is within the cache's size limit.
+// Temporary files count against the limit, but are not evicted,
+// unless they are stale (older than diskTmpAge), in which case they
+// are always removed.
+func (d *diskCache) evict() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ents, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	var fis []os.FileInfo
+	var total int64
+	for _, e := range ents {
+		tmp := strings.HasPrefix(e.Name(), diskTmp)
+		if !tmp && !strings.HasSuffix(e.Name(), diskExt) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if !tmp {
+			fis = append(fis, fi)
+		} else if time.Since(fi.ModTime()) > diskTmpAge {
+			os.Remove(filepath.Join(d.dir, fi.Name()))
+			continue
+		}
+		total += fi.Size()
+	}
+	sort.Slice(fis, func(i, j int) bool {
+		return fis[i].ModTime().Before(fis[j].ModTime())
+	})
+	for _, fi := range fis {
+		if total <= d.maxBytes {
+			break
+		}
+		if os.Remove(filepath.Join(d.dir, fi.Name())) == nil {
+			total -= fi.Size()
+		}
+	}
+	return nil
+}
+
+// writeInts writes the values "v" to "w" as little-endian uint32's.
+func writeInts(w io.Writer, v []int) error {
+	b := make([]uint32, diskChunk)
+	for len(v) > 0 {
+		n := len(v)
+		if n > diskChunk {
+			n = diskChunk
+		}
+		for i := 0; i < n; i++ {
+			b[i] = uint32(v[i])
+		}
+		err := binary.Write(w, binary.LittleEndian, b[:n])
+		if err != nil {
+			return err
+		}
+		v = v[n:]
+	}
+	return nil
+}
+
+// readInts reads len(v) little-endian uint32's from "r" into "v".
+func readInts(r io.Reader, v []int) error {
+	b := make([]uint32, diskChunk)
+	for len(v) > 0 {
+		n := len(v)
+		if n > diskChunk {
+			n = diskChunk
+		}
+		err := binary.Read(r, binary.LittleEndian, b[:n])
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			v[i] = int(b[i])
+		}
+		v = v[n:]
+	}
+	return nil
+}
+
+// writeZs writes the complex values "v" to "w" as pairs of
+// little-endian float64's.
+func writeZs(w io.Writer, v []complex128) error {
+	b := make([]float64, 2*diskChunk)
+	for len(v) > 0 {
+		n := len(v)
+		if n > diskChunk {
+			n = diskChunk
+		}
+		for i := 0; i < n; i++ {
+			b[2*i], b[2*i+1] = real(v[i]), imag(v[i])
+		}
+		err := binary.Write(w, binary.LittleEndian, b[:2*n])
+		if err != nil {
+			return err
+		}
+		v = v[n:]
+	}
+	return nil
+}
+
+// readZs reads len(v) pairs of little-endian float64's from "r" into
+// the complex values "v".
+func readZs(r io.Reader, v []complex128) error {
+	b := make([]float64, 2*diskChunk)
+	for len(v) > 0 {
+		n := len(v)
+		if n > diskChunk {
+			n = diskChunk
+		}
+		err := binary.Read(r, binary.LittleEndian, b[:2*n])
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			v[i] = complex(b[2*i], b[2*i+1])
+		}
+		v = v[n:]
+	}
+	return nil
+}
+
+// writeTo writes the image's parameters and data (the pix, histo, and
+// zs arrays, compressed) to "w", in the disk-cache file format.
+// Returns non-nil error if the image's final z values are not
+// available (e.g. for resampled images).
+func (m *mandelImg) writeTo(w io.Writer) error {
+	if m.zs == nil {
+		return errors.New("writeTo: Final z values not available")
+	}
+	h := diskHdr{
+		Version: diskVersion,
+		W:       uint32(m.w), H: uint32(m.h),
+		MaxIter: uint32(m.MaxIter),
+		X0:      real(m.C0), Y0: imag(m.C0),
+		X1: real(m.C1), Y1: imag(m.C1),
+		Radius: m.Radius,
+	}
+	copy(h.Magic[:], diskMagic)
+	if err := binary.Write(w, binary.LittleEndian, &h); err != nil {
+		return err
+	}
+	zw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err := writeInts(zw, m.pix); err != nil {
+		return err
+	}
+	if err := writeInts(zw, m.histo); err != nil {
+		return err
+	}
+	if err := writeZs(zw, m.zs); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// readImg reads an image in the disk-cache file format from "r".
+// Returns non-nil error if the data are invalid or corrupted. The
+// returned image has a nil palette.
+func readImg(r io.Reader) (*mandelImg, error) {
+	var h diskHdr
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if string(h.Magic[:]) != diskMagic || h.Version != diskVersion {
+		return nil, errors.New("readImg: bad magic or version")
+	}
+	if h.W == 0 || h.W > maxSx || h.H == 0 || h.H > maxSy ||
+		h.MaxIter == 0 || h.MaxIter > maxIter {
+		return nil, errors.New("readImg: bad image parameters")
+	}
+	m := &mandelImg{}
+	m.C0, m.C1 = complex(h.X0, h.Y0), complex(h.X1, h.Y1)
+	m.MaxIter = int(h.MaxIter)
+	m.Radius = h.Radius
+	m.w, m.h = int(h.W), int(h.H)
+	m.pix = make([]int, m.w*m.h)
+	m.histo = make([]int, m.MaxIter+1)
+	m.cnhisto = make([]float64, m.MaxIter)
+	m.rnhisto = make([]float64, m.MaxIter)
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := readInts(zr, m.pix); err != nil {
+		return nil, err
+	}
+	if err := readInts(zr, m.histo); err != nil {
+		return nil, err
+	}
+	if m.histo[m.MaxIter] > len(m.pix) {
+		return nil, errors.New("readImg: bad histogram")
+	}
+	m.zs = make([]complex128, m.histo[m.MaxIter])
+	if err := readZs(zr, m.zs); err != nil {
+		return nil, err
+	}
+	// Read to EOF, so that gzip verifies the data checksum
+	if n, err := io.Copy(io.Discard, zr); err != nil || n != 0 {
+		return nil, errors.New("readImg: bad data")
+	}
+	// Cross-check pix and histo
+	histo := make([]int, m.MaxIter+1)
+	for _, v := range m.pix {
+		if v < 0 || v > m.MaxIter {
+			return nil, errors.New("readImg: bad pixel value")
+		}
+		histo[v]++
+	}
+	for i := range histo {
+		if histo[i] != m.histo[i] {
+			return nil, errors.New("readImg: bad histogram")
+		}
+	}
+	m.calcHisto()
+	return m, nil
+}
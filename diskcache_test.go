@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	d, err := newDiskCache(t.TempDir(), 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMandelImg(context.Background(), 160, 120, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 64, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := imgKey(m)
+	if d.load(k) != nil {
+		t.Fatal("image found in empty cache")
+	}
+	if err := d.store(m); err != nil {
+		t.Fatal(err)
+	}
+	ml := d.load(k)
+	if ml == nil {
+		t.Fatal("image not found")
+	}
+	if imgKey(ml) != k || ml.Radius != m.Radius {
+		t.Fatalf("bad image parameters: %v", imgKey(ml))
+	}
+	for i := range m.pix {
+		if ml.pix[i] != m.pix[i] {
+			t.Fatalf("pix[%d] = %d != %d", i, ml.pix[i], m.pix[i])
+		}
+	}
+	for i := range m.cnhisto {
+		if ml.cnhisto[i] != m.cnhisto[i] {
+			t.Fatalf("cnhisto[%d] = %f != %f",
+				i, ml.cnhisto[i], m.cnhisto[i])
+		}
+	}
+	// Corrupt the file
+	fn := d.path(k)
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/2] ^= 0xff
+	if err := os.WriteFile(fn, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if d.load(k) != nil {
+		t.Fatal("corrupted image loaded")
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Fatal("corrupted file not removed")
+	}
+}
+
+func TestDiskCacheEvict(t *testing.T) {
+	dir := t.TempDir()
+	d, err := newDiskCache(dir, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ks []cacheKey
+	for i := 0; i < 3; i++ {
+		m, err := newMandelImg(context.Background(), 160, 120, pal256Gray,
+			complex(-2.0, -1.2), complex(1.0, 1.2), 16+i, 2, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.store(m); err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, imgKey(m))
+	}
+	fis, _ := filepath.Glob(filepath.Join(dir, "*"+diskExt))
+	if len(fis) != 3 {
+		t.Fatalf("%d files", len(fis))
+	}
+	// Make ks[0] the most recently used, then shrink the cache
+	// to fit a single file
+	for i, k := range ks {
+		fi, _ := os.Stat(d.path(k))
+		tm := fi.ModTime().Add(-time.Duration(10-i) * time.Hour)
+		os.Chtimes(d.path(k), tm, tm)
+	}
+	if d.load(ks[0]) == nil {
+		t.Fatal("image not found")
+	}
+	fi, _ := os.Stat(d.path(ks[0]))
+	d.maxBytes = fi.Size()
+	d.evict()
+	if d.load(ks[0]) == nil {
+		t.Fatal("most recently used file evicted")
+	}
+	for _, k := range ks[1:] {
+		if _, err := os.Stat(d.path(k)); !os.IsNotExist(err) {
+			t.Fatal("file not evicted")
+		}
+	}
+}
+
+func TestDiskCacheTmp(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, diskTmp+"1")
+	fresh := filepath.Join(dir, diskTmp+"2")
+	for _, fn := range []string{stale, fresh} {
+		if err := os.WriteFile(fn, make([]byte, 100), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tm := time.Now().Add(-2 * diskTmpAge)
+	os.Chtimes(stale, tm, tm)
+	d, err := newDiskCache(dir, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("stale temporary file not removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Error("temporary file removed")
+	}
+	// Temporary files count against the size limit
+	m, err := newMandelImg(context.Background(), 160, 120, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 16, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.store(m); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := os.Stat(d.path(imgKey(m)))
+	d.maxBytes = fi.Size() + 50
+	d.evict()
+	if _, err := os.Stat(d.path(imgKey(m))); !os.IsNotExist(err) {
+		t.Error("file not evicted")
+	}
+}
@@ -0,0 +1,184 @@
+// Cache encoded (PNG, GIF, etc.) images
+
+package main
+
+import (
+	"container/list"
+)
+
+type encCache struct {
+	// List of *encEntry (the cache itself), least recently used
+	// first
+	l *list.List
+	// Cache entries keyed by encEntry.key
+	m map[string]*list.Element
+	// Max total size of cached data (in bytes)
+	maxBytes int64
+	// Current total size of cached data (in bytes)
+	bytes int64
+	// Channel to receive add requests from
+	chAdd chan *encEntry
+	// Channel to receive lookup requests from
+	chLookup chan encLookupReq
+	// Channel to receive statistics requests from
+	chStats chan chan *encStats
+	// Channel to receive purge requests from
+	chPurge chan chan int
+	// Counters
+	cnt encCounters
+}
+
+// encEntry is an entry in the encoded-images cache
+type encEntry struct {
+	// Key identifying the encoded image. Must include everything
+	// that affects the encoded data (image parameters, palette,
+	// format, etc.)
+	key string
+	// Encoded image data
+	b []byte
+}
+
+// encLookupReq is the lookup request structure (send on
+// encCache.chLookup)
+type encLookupReq struct {
+	key string
+	// Chan to send reply to
+	ch chan []byte
+}
+
+// encCounters are the encoded-images cache event counters
+type encCounters struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Adds      int64 `json:"adds"`
+	Evictions int64 `json:"evictions"`
+	Purges    int64 `json:"purges"`
+}
+
+// encStats is a snapshot of the encoded-images cache statistics
+type encStats struct {
+	Entries  int         `json:"entries"`
+	Bytes    int64       `json:"bytes"`
+	MaxBytes int64       `json:"max_bytes"`
+	Counters encCounters `json:"counters"`
+}
+
+func (c *encCache) search(key string) []byte {
+	e := c.m[key]
+	if e == nil {
+		c.cnt.Misses++
+		return nil
+	}
+	c.cnt.Hits++
+	c.l.MoveToBack(e)
+	return e.Value.(*encEntry).b
+}
+
+func (c *encCache) add(ee *encEntry) {
+	if _, ok := c.m[ee.key]; ok {
+		return
+	}
+	sz := int64(len(ee.b))
+	if sz > c.maxBytes {
+		return
+	}
+	c.m[ee.key] = c.l.PushBack(ee)
+	c.bytes += sz
+	c.cnt.Adds++
+	for c.bytes > c.maxBytes {
+		c.remove(c.l.Front())
+		c.cnt.Evictions++
+	}
+}
+
+// remove removes element "e" from the cache
+func (c *encCache) remove(e *list.Element) {
+	ee := e.Value.(*encEntry)
+	c.bytes -= int64(len(ee.b))
+	delete(c.m, ee.key)
+	c.l.Remove(e)
+}
+
+// purge removes all entries from the cache. Returns the number of
+// entries removed.
+func (c *encCache) purge() int {
+	n := c.l.Len()
+	for c.l.Len() > 0 {
+		c.remove(c.l.Front())
+	}
+	c.cnt.Purges += int64(n)
+	return n
+}
+
+func (c *encCache) stats() *encStats {
+	return &encStats{
+		Entries:  c.l.Len(),
+		Bytes:    c.bytes,
+		MaxBytes: c.maxBytes,
+		Counters: c.cnt,
+	}
+}
+
+// ReqLookup requests a cache-lookup for the encoded image with the
+// given key. Returns the encoded image data if found, nil otherwise.
+// The returned data must not be modified.
+func (c *encCache) ReqLookup(key string) []byte {
+	ch := make(chan []byte)
+	c.chLookup <- encLookupReq{key, ch}
+	return <-ch
+}
+
+// ReqAdd requests that the encoded image data "b" are added to the
+// cache with the given key. The data must not be modified after
+// calling ReqAdd. The least recently used entries may be evicted as a
+// result of calling ReqAdd (if the total size of the cached data
+// exceeds the cache's size limit).
+func (c *encCache) ReqAdd(key string, b []byte) {
+	c.chAdd <- &encEntry{key, b}
+}
+
+// ReqStats requests a snapshot of the cache statistics.
+func (c *encCache) ReqStats() *encStats {
+	ch := make(chan *encStats)
+	c.chStats <- ch
+	return <-ch
+}
+
+// ReqPurge requests that all entries are removed from the
+// cache. Returns the number of entries removed.
+func (c *encCache) ReqPurge() int {
+	ch := make(chan int)
+	c.chPurge <- ch
+	return <-ch
+}
+
+// newEncCache creates and initializes an encoded-images cache that
+// keeps up to maxBytes of data, and starts the goroutine that
+// receives and processes the cache requests. Returns a pointer to the
+// newly created cache.
+func newEncCache(maxBytes int64) *encCache {
+	c := new(encCache)
+	c.l = list.New()
+	c.m = make(map[string]*list.Element)
+	c.maxBytes = maxBytes
+	c.chAdd = make(chan *encEntry)
+	c.chLookup = make(chan encLookupReq)
+	c.chStats = make(chan chan *encStats)
+	c.chPurge = make(chan chan int)
+	go func(c *encCache) {
+		for {
+			select {
+			case lup := <-c.chLookup:
+				lup.ch <- c.search(lup.key)
+			case ee := <-c.chAdd:
+				c.add(ee)
+			case ch := <-c.chStats:
+				ch <- c.stats()
+			case ch := <-c.chPurge:
+				ch <- c.purge()
+			}
+		}
+	}(c)
+
+	return c
+}
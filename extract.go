@@ -0,0 +1,121 @@
+// Extract palettes from user-supplied images
+
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Max size of uploaded images (in bytes)
+	maxUpload = 16 * 1024 * 1024
+	// Max size of uploaded images (in pixels, decoded)
+	maxExtractPix = 64 * 1024 * 1024
+	// Number of colors to extract
+	minColors = 2
+	maxColors = 32
+	dflColors = 8
+	// Max length of palette names
+	maxPalName = 32
+)
+
+// extractHandler receives an uploaded image (PNG or JPEG), extracts a
+// palette from it, and registers the palette in the user's
+// session. Then it redirects to the main page, displaying the view
+// given in the "view" parameter with the new palette.
+func extractHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+	err := r.ParseMultipartForm(maxUpload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n := valInt(nil, r, "colors", minColors, maxColors, dflColors)
+	path := r.FormValue("order") == "path"
+	f, _, err := r.FormFile("img")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	// Check the size before decoding: A small upload may declare a
+	// huge image.
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		http.Error(w, "Bad image: "+err.Error(),
+			http.StatusBadRequest)
+		return
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxExtractPix {
+		http.Error(w, fmt.Sprintf("Image too large: %dx%d",
+			cfg.Width, cfg.Height), http.StatusBadRequest)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		http.Error(w, "Bad image: "+err.Error(),
+			http.StatusBadRequest)
+		return
+	}
+	pts, err := imgPalPts(img, n, path, custPalSize)
+	if err != nil {
+		http.Error(w, "Bad image: "+err.Error(),
+			http.StatusBadRequest)
+		return
+	}
+	name := palName(r.FormValue("name"))
+	err = sessions.addPalette(w, r, name, pts, custPalSize)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Palette %q: %s", name, err),
+			http.StatusBadRequest)
+		return
+	}
+	v, _ := url.ParseQuery(r.FormValue("view"))
+	v.Set("pal", name)
+	v.Del("cpal")
+	http.Redirect(w, r, "/?"+v.Encode(), http.StatusSeeOther)
+}
+
+// palName sanitizes the user-supplied palette name "s": It removes
+// non-printable characters and limits its length (in bytes, without
+// splitting characters). If the resulting name is empty, returns a
+// default name.
+func palName(s string) string {
+	s = strings.Map(func(c rune) rune {
+		if c < ' ' || c == 0x7f {
+			return -1
+		}
+		return c
+	}, s)
+	s = strings.TrimSpace(s)
+	if len(s) > maxPalName {
+		// Don't split a multi-byte character
+		n := maxPalName
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = strings.TrimSpace(s[:n])
+	}
+	if s == "" {
+		s = "Image"
+	}
+	return s
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// pngHeader returns the start of a PNG image of size "w" x "h": The
+// signature and the IHDR chunk, with no image data.
+func pngHeader(w, h uint32) []byte {
+	b := []byte("\x89PNG\r\n\x1a\n")
+	c := []byte("IHDR")
+	c = binary.BigEndian.AppendUint32(c, w)
+	c = binary.BigEndian.AppendUint32(c, h)
+	// 8-bit RGBA, no interlacing
+	c = append(c, 8, 6, 0, 0, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(c)-4))
+	b = append(b, c...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(c))
+}
+
+func TestExtractHandler(t *testing.T) {
+	upload := func(img []byte) (int, string) {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		fw, _ := mw.CreateFormFile("img", "img.png")
+		fw.Write(img)
+		mw.WriteField("name", "Test")
+		mw.Close()
+		r := httptest.NewRequest("POST", "/palette/extract", &b)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		extractHandler(w, r)
+		return w.Code, w.Body.String()
+	}
+	m := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 7)
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, m); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := upload(b.Bytes()); c != http.StatusSeeOther {
+		t.Errorf("image: status %d", c)
+	}
+	// Declares 50000x50000 pixels; rejected before decoding
+	c, msg := upload(pngHeader(50000, 50000))
+	if c != http.StatusBadRequest || !strings.Contains(msg, "too large") {
+		t.Errorf("huge image: status %d: %s", c, msg)
+	}
+	if c, _ := upload([]byte("not an image")); c != http.StatusBadRequest {
+		t.Errorf("bad image: status %d", c)
+	}
+}
+
+func TestPalName(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"Sunset", "Sunset"},
+		{" a\tb\x7f ", "ab"},
+		{"\n", "Image"},
+		{strings.Repeat("x", 40), strings.Repeat("x", maxPalName)},
+		// 2-byte characters; byte 32 is in the middle of one
+		{"a" + strings.Repeat("é", 20), "a" + strings.Repeat("é", 15)},
+	}
+	for _, tc := range tests {
+		n := palName(tc.s)
+		if n != tc.want || !utf8.ValidString(n) {
+			t.Errorf("%q: %q", tc.s, n)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+// IIIF Image API
+
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// iiifContext is the JSON-LD context of the IIIF Image API (version 3)
+const iiifContext = "http://iiif.io/api/image/3/context.json"
+
+// iiifFormats are the supported image formats, with their content
+// types. iiifOtherFormats are the formats defined by the API that are
+// not supported.
+var (
+	iiifFormats = map[string]string{
+		"png": "image/png",
+		"jpg": "image/jpeg",
+		"gif": "image/gif",
+	}
+	iiifOtherFormats = map[string]bool{
+		"tif": true, "jp2": true, "pdf": true, "webp": true,
+	}
+)
+
+// iiifError is returned when an IIIF request cannot be served.
+type iiifError struct {
+	// HTTP status code to respond with
+	code int
+	msg  string
+}
+
+func (e *iiifError) Error() string { return e.msg }
+
+func iiifBad(msg string) *iiifError {
+	return &iiifError{http.StatusBadRequest, msg}
+}
+
+// iiifRequest is a parsed IIIF image request.
+type iiifRequest struct {
+	// Region, in pixels of the full image
+	rx, ry, rw, rh int
+	// Size the region is scaled to
+	w, h int
+	// Mirror (flip horizontally), then rotate by rot degrees
+	// clockwise (a multiple of 90)
+	mirror bool
+	rot    int
+	// Quality (color, gray, or bitonal) and format
+	quality string
+	format  string
+}
+
+// iiifNums parses "s" as "n" comma-separated, non-negative numbers.
+func iiifNums(s string, n int) ([]float64, bool) {
+	f := strings.Split(s, ",")
+	if len(f) != n {
+		return nil, false
+	}
+	v := make([]float64, n)
+	for i := range f {
+		x, err := strconv.ParseFloat(f[i], 64)
+		if err != nil || math.IsNaN(x) || math.IsInf(x, 0) || x < 0 {
+			return nil, false
+		}
+		v[i] = x
+	}
+	return v, true
+}
+
+// isInt returns true if all the numbers in "v" are integers.
+func isInt(v []float64) bool {
+	for _, x := range v {
+		if x != math.Floor(x) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRegion parses the region "s" of an image of w x h pixels.
+// Regions extending past the image are cropped.
+func (q *iiifRequest) parseRegion(s string, w, h int) *iiifError {
+	switch {
+	case s == "full":
+		q.rx, q.ry, q.rw, q.rh = 0, 0, w, h
+	case s == "square":
+		if w > h {
+			q.rx, q.ry, q.rw, q.rh = (w-h)/2, 0, h, h
+		} else {
+			q.rx, q.ry, q.rw, q.rh = 0, (h-w)/2, w, w
+		}
+	case strings.HasPrefix(s, "pct:"):
+		v, ok := iiifNums(s[4:], 4)
+		if !ok {
+			return iiifBad("invalid region " + s)
+		}
+		pct := func(x float64, n int) int {
+			return int(math.Floor(x*float64(n)/100 + 0.5))
+		}
+		q.rx, q.ry = pct(v[0], w), pct(v[1], h)
+		q.rw, q.rh = pct(v[2], w), pct(v[3], h)
+	default:
+		v, ok := iiifNums(s, 4)
+		if !ok || !isInt(v) {
+			return iiifBad("invalid region " + s)
+		}
+		q.rx, q.ry, q.rw, q.rh = int(v[0]), int(v[1]), int(v[2]),
+			int(v[3])
+	}
+	if q.rw <= 0 || q.rh <= 0 || q.rx >= w || q.ry >= h {
+		return iiifBad("empty region " + s)
+	}
+	if q.rx+q.rw > w {
+		q.rw = w - q.rx
+	}
+	if q.ry+q.rh > h {
+		q.rh = h - q.ry
+	}
+	return nil
+}
+
+// parseSize parses the size "s" (the size to scale the region to).
+// Without the "^" prefix, regions cannot be scaled up. The size is
+// limited to maxSx x maxSy.
+func (q *iiifRequest) parseSize(s string) *iiifError {
+	up := strings.HasPrefix(s, "^")
+	s = strings.TrimPrefix(s, "^")
+	rw, rh := float64(q.rw), float64(q.rh)
+	round := func(x float64) int {
+		if n := int(math.Floor(x + 0.5)); n > 1 {
+			return n
+		}
+		return 1
+	}
+	switch {
+	case s == "max" || s == "full":
+		// Scale down (or, if "up", up) to the size limits
+		sc := math.Min(maxSx/rw, maxSy/rh)
+		if sc > 1 && !up {
+			sc = 1
+		}
+		q.w, q.h = round(rw*sc), round(rh*sc)
+		if q.w > maxSx {
+			q.w = maxSx
+		}
+		if q.h > maxSy {
+			q.h = maxSy
+		}
+		return nil
+	case strings.HasPrefix(s, "pct:"):
+		v, ok := iiifNums(s[4:], 1)
+		if !ok || v[0] == 0 {
+			return iiifBad("invalid size " + s)
+		}
+		q.w, q.h = round(rw*v[0]/100), round(rh*v[0]/100)
+	case strings.HasPrefix(s, "!"):
+		v, ok := iiifNums(s[1:], 2)
+		if !ok || !isInt(v) || v[0] == 0 || v[1] == 0 {
+			return iiifBad("invalid size " + s)
+		}
+		sc := math.Min(v[0]/rw, v[1]/rh)
+		if sc > 1 && !up {
+			sc = 1
+		}
+		q.w, q.h = round(rw*sc), round(rh*sc)
+		if q.w > int(v[0]) {
+			q.w = int(v[0])
+		}
+		if q.h > int(v[1]) {
+			q.h = int(v[1])
+		}
+	case strings.HasSuffix(s, ","):
+		v, ok := iiifNums(s[:len(s)-1], 1)
+		if !ok || !isInt(v) || v[0] == 0 {
+			return iiifBad("invalid size " + s)
+		}
+		q.w, q.h = int(v[0]), round(rh*v[0]/rw)
+	case strings.HasPrefix(s, ","):
+		v, ok := iiifNums(s[1:], 1)
+		if !ok || !isInt(v) || v[0] == 0 {
+			return iiifBad("invalid size " + s)
+		}
+		q.w, q.h = round(rw*v[0]/rh), int(v[0])
+	default:
+		v, ok := iiifNums(s, 2)
+		if !ok || !isInt(v) || v[0] == 0 || v[1] == 0 {
+			return iiifBad("invalid size " + s)
+		}
+		q.w, q.h = int(v[0]), int(v[1])
+	}
+	if !up && (q.w > q.rw || q.h > q.rh) {
+		return iiifBad("size " + s + " larger than region; use ^" + s)
+	}
+	if q.w > maxSx || q.h > maxSy {
+		return iiifBad("size " + s + " too large")
+	}
+	return nil
+}
+
+// parseRotation parses the rotation "s". Only rotations by multiples
+// of 90 degrees are supported.
+func (q *iiifRequest) parseRotation(s string) *iiifError {
+	q.mirror = strings.HasPrefix(s, "!")
+	v, ok := iiifNums(strings.TrimPrefix(s, "!"), 1)
+	if !ok || v[0] > 360 {
+		return iiifBad("invalid rotation " + s)
+	}
+	if math.Mod(v[0], 90) != 0 {
+		return &iiifError{http.StatusNotImplemented,
+			"rotation " + s + " not supported"}
+	}
+	q.rot = int(v[0]) % 360
+	return nil
+}
+
+// parseQuality parses the quality and format "s" (e.g.
+// "default.png").
+func (q *iiifRequest) parseQuality(s string) *iiifError {
+	i := strings.LastIndexByte(s, '.')
+	if i < 0 {
+		return iiifBad("missing format")
+	}
+	q.quality, q.format = s[:i], s[i+1:]
+	switch q.quality {
+	case "default", "color":
+		q.quality = "color"
+	case "gray", "bitonal":
+	default:
+		return iiifBad("invalid quality " + q.quality)
+	}
+	if iiifFormats[q.format] == "" {
+		if iiifOtherFormats[q.format] {
+			return &iiifError{http.StatusNotImplemented,
+				"format " + q.format + " not supported"}
+		}
+		return iiifBad("invalid format " + q.format)
+	}
+	return nil
+}
+
+// parseIIIF parses the image request path segments "region", "size",
+// "rotation", and "quality.format", for an image of w x h pixels.
+func parseIIIF(seg []string, w, h int) (*iiifRequest, *iiifError) {
+	q := &iiifRequest{}
+	if err := q.parseRegion(seg[0], w, h); err != nil {
+		return nil, err
+	}
+	if err := q.parseSize(seg[1]); err != nil {
+		return nil, err
+	}
+	if err := q.parseRotation(seg[2]); err != nil {
+		return nil, err
+	}
+	if err := q.parseQuality(seg[3]); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// transform applies the mirroring, rotation, and quality of the
+// request to image "img".
+func (q *iiifRequest) transform(img image.Image) image.Image {
+	if !q.mirror && q.rot == 0 && q.quality == "color" {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if q.rot == 90 || q.rot == 270 {
+		dw, dh = h, w
+	}
+	var dst draw.Image
+	if q.quality == "color" {
+		dst = image.NewRGBA(image.Rect(0, 0, dw, dh))
+	} else {
+		dst = image.NewGray(image.Rect(0, 0, dw, dh))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sx := x
+			if q.mirror {
+				sx = w - 1 - x
+			}
+			c := img.At(b.Min.X+sx, b.Min.Y+y)
+			if q.quality == "bitonal" {
+				g := color.GrayModel.Convert(c).(color.Gray)
+				if g.Y >= 128 {
+					c = color.White
+				} else {
+					c = color.Black
+				}
+			}
+			var dx, dy int
+			switch q.rot {
+			case 0:
+				dx, dy = x, y
+			case 90:
+				dx, dy = h-1-y, x
+			case 180:
+				dx, dy = w-1-x, h-1-y
+			case 270:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, c)
+		}
+	}
+	return dst
+}
+
+// iiifInfo is the image information document (info.json).
+type iiifInfo struct {
+	Context        string      `json:"@context"`
+	ID             string      `json:"id"`
+	Type           string      `json:"type"`
+	Protocol       string      `json:"protocol"`
+	Profile        string      `json:"profile"`
+	Width          int         `json:"width"`
+	Height         int         `json:"height"`
+	MaxWidth       int         `json:"maxWidth"`
+	MaxHeight      int         `json:"maxHeight"`
+	Tiles          []iiifTiles `json:"tiles"`
+	ExtraQualities []string    `json:"extraQualities"`
+	ExtraFormats   []string    `json:"extraFormats"`
+	ExtraFeatures  []string    `json:"extraFeatures"`
+}
+
+type iiifTiles struct {
+	Width        int   `json:"width"`
+	ScaleFactors []int `json:"scaleFactors"`
+}
+
+// newIIIFInfo returns the image information for the image with
+// parameters "p", served at base URI "base".
+func newIIIFInfo(base string, p *params) *iiifInfo {
+	t := iiifTiles{Width: dziTileSize}
+	for sf := 1; ; sf *= 2 {
+		t.ScaleFactors = append(t.ScaleFactors, sf)
+		if dziTileSize*sf >= p.Sx && dziTileSize*sf >= p.Sy {
+			break
+		}
+	}
+	return &iiifInfo{
+		Context:        iiifContext,
+		ID:             base,
+		Type:           "ImageService3",
+		Protocol:       "http://iiif.io/api/image",
+		Profile:        "level2",
+		Width:          p.Sx,
+		Height:         p.Sy,
+		MaxWidth:       maxSx,
+		MaxHeight:      maxSy,
+		Tiles:          []iiifTiles{t},
+		ExtraQualities: []string{"color", "gray", "bitonal"},
+		ExtraFormats:   []string{"gif"},
+		ExtraFeatures:  []string{"mirroring", "sizeUpscaling"},
+	}
+}
+
+// baseURL returns the scheme and host (e.g. "http://host:8080") the
+// request "r" was sent to. With flag -trust-proxy, the scheme is
+// taken from the X-Forwarded-Proto header, if present.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if *trustProxy {
+		if xfp := r.Header.Get("X-Forwarded-Proto"); xfp != "" {
+			scheme = xfp
+		}
+	}
+	return scheme + "://" + r.Host
+}
+
+// iiifHandler serves the IIIF Image API (version 3, level 2): The
+// image information at /iiif/<id>/info.json, and images at
+// /iiif/<id>/<region>/<size>/<rotation>/<quality>.<format>. The base
+// URI (/iiif/<id>) redirects to the image information. The identifier
+// <id> specifies the image (see deepParams).
+func iiifHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	seg := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(),
+		"/iiif/"), "/")
+	id := seg[0]
+	for i := range seg {
+		s, err := url.PathUnescape(seg[i])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		seg[i] = s
+	}
+	p := deepParams(r, seg[0])
+	if p.Strict && p.Errors != nil {
+		paramsError(w, r, p.Errors)
+		return
+	}
+	base := baseURL(r) + "/iiif/" + id
+	switch {
+	case len(seg) == 1 || (len(seg) == 2 && seg[1] == ""):
+		http.Redirect(w, r, base+"/info.json", http.StatusSeeOther)
+		return
+	case len(seg) == 2 && seg[1] == "info.json":
+		ct := "application/json"
+		if strings.Contains(r.Header.Get("Accept"),
+			"application/ld+json") {
+			ct = `application/ld+json;profile="` + iiifContext + `"`
+		}
+		w.Header().Set("Content-Type", ct)
+		json.NewEncoder(w).Encode(newIIIFInfo(base, p))
+		return
+	case len(seg) != 5:
+		http.NotFound(w, r)
+		return
+	}
+	q, ierr := parseIIIF(seg[1:], p.Sx, p.Sy)
+	if ierr != nil {
+		http.Error(w, ierr.msg, ierr.code)
+		return
+	}
+	w.Header().Set("Content-Type", iiifFormats[q.format])
+	w.Header().Set("Link",
+		`<http://iiif.io/api/image/3/level2.json>;rel="profile"`)
+	// Replied without rendering the image
+	if r.Method == "HEAD" {
+		return
+	}
+	rp := regionParams(p, q.rx, q.ry, q.rw, q.rh, q.w, q.h)
+	release, err := admitRender(r, rp)
+	if err != nil {
+		http.Error(w, err.Error(), admitStatus(w, err))
+		return
+	}
+	img, err := getImg(r.Context(), rp)
+	release()
+	if err != nil {
+		http.Error(w, err.Error(), renderStatus(err))
+		return
+	}
+	out := q.transform(img)
+	switch q.format {
+	case "png":
+		png.Encode(w, out)
+	case "jpg":
+		jpeg.Encode(w, out, &jpeg.Options{Quality: 90})
+	case "gif":
+		gif.Encode(w, out, nil)
+	}
+}
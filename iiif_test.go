@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIIIF(t *testing.T) {
+	saved := imgCache
+	defer func() { imgCache = saved }()
+	imgCache = newCache(1 << 30)
+	// 1000 x 800 pixels, default domain
+	const base = "/iiif/sx=1000&sy=800"
+	tests := []struct {
+		path string
+		code int
+		w, h int
+	}{
+		{"/full/max/0/default.png", 200, 1000, 800},
+		{"/full/full/0/default.png", 200, 1000, 800},
+		{"/full/max/0/color.jpg", 200, 1000, 800},
+		{"/full/max/0/default.gif", 200, 1000, 800},
+		{"/full/500,/0/default.png", 200, 500, 400},
+		{"/full/,400/0/default.png", 200, 500, 400},
+		{"/full/pct:50/0/default.png", 200, 500, 400},
+		{"/full/!300,300/0/default.png", 200, 300, 240},
+		{"/full/300,300/0/default.png", 200, 300, 300},
+		{"/full/^2000,/0/default.png", 200, 2000, 1600},
+		{"/full/%5E1100,/0/default.png", 200, 1100, 880},
+		{"/square/100,/0/default.png", 200, 100, 100},
+		{"/0,0,256,256/256,/0/default.png", 200, 256, 256},
+		{"/900,700,256,256/max/0/default.png", 200, 100, 100},
+		{"/pct:50,50,50,50/max/0/default.png", 200, 500, 400},
+		{"/pct:10.5,0,10,10/max/0/default.png", 200, 100, 80},
+		{"/full/500,/90/default.png", 200, 400, 500},
+		{"/full/500,/270/default.png", 200, 400, 500},
+		{"/full/500,/!180/default.png", 200, 500, 400},
+		{"/full/500,/360/default.png", 200, 500, 400},
+		{"/full/500,/0/gray.png", 200, 500, 400},
+		{"/full/500,/0/bitonal.png", 200, 500, 400},
+		{"/full/2000,/0/default.png", 400, 0, 0},
+		{"/full/pct:150/0/default.png", 400, 0, 0},
+		{"/full/0,/0/default.png", 400, 0, 0},
+		{"/full/20000,/0/default.png", 400, 0, 0},
+		{"/full/^20000,/0/default.png", 400, 0, 0},
+		{"/full/a,b/0/default.png", 400, 0, 0},
+		{"/1000,0,10,10/max/0/default.png", 400, 0, 0},
+		{"/0,0,0,10/max/0/default.png", 400, 0, 0},
+		{"/0,0,10.5,10/max/0/default.png", 400, 0, 0},
+		{"/-1,0,10,10/max/0/default.png", 400, 0, 0},
+		{"/bogus/max/0/default.png", 400, 0, 0},
+		{"/full/max/400/default.png", 400, 0, 0},
+		{"/full/max/45/default.png", 501, 0, 0},
+		{"/full/max/0/fancy.png", 400, 0, 0},
+		{"/full/max/0/default.bmp", 400, 0, 0},
+		{"/full/max/0/default.tif", 501, 0, 0},
+		{"/full/max/0/default", 400, 0, 0},
+		{"/full/max/0", 404, 0, 0},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		iiifHandler(w, httptest.NewRequest("GET", base+tc.path, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s: status %d, want %d: %s",
+				tc.path, w.Code, tc.code, w.Body)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		if o := w.Header().Get("Access-Control-Allow-Origin"); o != "*" {
+			t.Errorf("%s: CORS header %q", tc.path, o)
+		}
+		var img image.Image
+		var err error
+		switch w.Header().Get("Content-Type") {
+		case "image/png":
+			img, err = png.Decode(w.Body)
+		case "image/jpeg":
+			img, err = jpeg.Decode(w.Body)
+		case "image/gif":
+			img, err = gif.Decode(w.Body)
+		default:
+			t.Errorf("%s: content type %s", tc.path,
+				w.Header().Get("Content-Type"))
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.path, err)
+			continue
+		}
+		if b := img.Bounds(); b.Dx() != tc.w || b.Dy() != tc.h {
+			t.Errorf("%s: size %dx%d, want %dx%d",
+				tc.path, b.Dx(), b.Dy(), tc.w, tc.h)
+		}
+	}
+}
+
+func TestIIIFHead(t *testing.T) {
+	saved := imgCache
+	defer func() { imgCache = saved }()
+	imgCache = newCache(1 << 30)
+	w := httptest.NewRecorder()
+	iiifHandler(w, httptest.NewRequest("HEAD",
+		"/iiif/sx=1000&sy=800/full/max/0/default.jpg", nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/jpeg" ||
+		w.Header().Get("Link") == "" {
+		t.Errorf("status %d, headers %v", w.Code, w.Header())
+	}
+	// Replied without rendering
+	if st := imgCache.ReqStats(); len(st.Entries) != 0 {
+		t.Errorf("%d images rendered", len(st.Entries))
+	}
+}
+
+func TestIIIFTransform(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i)
+	}
+	tests := []struct {
+		mirror bool
+		rot    int
+		want   []uint8
+	}{
+		{false, 90, []uint8{3, 0, 4, 1, 5, 2}},
+		{false, 180, []uint8{5, 4, 3, 2, 1, 0}},
+		{false, 270, []uint8{2, 5, 1, 4, 0, 3}},
+		{true, 0, []uint8{2, 1, 0, 5, 4, 3}},
+		{true, 90, []uint8{5, 2, 4, 1, 3, 0}},
+	}
+	for _, tc := range tests {
+		q := &iiifRequest{mirror: tc.mirror, rot: tc.rot, quality: "gray"}
+		g := q.transform(m).(*image.Gray)
+		for i := range tc.want {
+			if g.Pix[i] != tc.want[i] {
+				t.Errorf("mirror %v, rot %d: %v, want %v",
+					tc.mirror, tc.rot, g.Pix, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestIIIFInfo(t *testing.T) {
+	w := httptest.NewRecorder()
+	iiifHandler(w, httptest.NewRequest("GET",
+		"http://example.com/iiif/sx=1000&sy=800", nil))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") !=
+		"http://example.com/iiif/sx=1000&sy=800/info.json" {
+		t.Errorf("base URI: status %d, location %s",
+			w.Code, w.Header().Get("Location"))
+	}
+	w = httptest.NewRecorder()
+	iiifHandler(w, httptest.NewRequest("GET",
+		"http://example.com/iiif/sx=1000&sy=800/info.json", nil))
+	var info iiifInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != "http://example.com/iiif/sx=1000&sy=800" ||
+		info.Width != 1000 || info.Height != 800 ||
+		info.Context != iiifContext || info.Profile != "level2" {
+		t.Errorf("info %+v", info)
+	}
+	sf := info.Tiles[0].ScaleFactors
+	if len(sf) != 3 || sf[2] != 4 {
+		t.Errorf("scale factors %v", sf)
+	}
+}
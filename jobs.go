@@ -0,0 +1,369 @@
+// Asynchronous render jobs
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"image/png"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Max number of jobs queued or running. Finished jobs are kept
+	// too, up to this number, dropping the oldest ones first.
+	maxJobs = 1024
+	// Time finished jobs (and their results) are kept for
+	jobTTL = 30 * time.Minute
+	// Max total size of the results kept (in bytes, PNG-encoded).
+	// The oldest finished jobs are dropped when it is exceeded.
+	maxJobBytes = 256 * 1024 * 1024
+)
+
+// Job states
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+// job is an image render, run asynchronously.
+type job struct {
+	id string
+	p  *params
+	// Cancels the job's context
+	cancel context.CancelFunc
+	ctx    context.Context
+	// The following are protected by jobQueue.mu
+	state    string
+	progress float64
+	err      error
+	png      []byte
+	created  time.Time
+	started  time.Time
+	finished time.Time
+}
+
+// jobStatus is the JSON representation of a job's status.
+type jobStatus struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	// Percent complete
+	Progress  float64    `json:"progress"`
+	Error     string     `json:"error,omitempty"`
+	Spec      renderSpec `json:"spec"`
+	ResultURL string     `json:"result_url,omitempty"`
+	Created   time.Time  `json:"created"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+}
+
+// jobQueue runs render jobs, with a limited number of workers, in
+// the order they are submitted. It is safe for concurrent use.
+type jobQueue struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+	// Total size of the results kept, and its limit
+	bytes, maxBytes int
+	// Jobs waiting for a worker
+	ch chan *job
+}
+
+// newJobQueue creates a job queue with "workers" workers, and room
+// for "queued" jobs waiting for a worker, and starts the workers.
+func newJobQueue(workers, queued int) *jobQueue {
+	q := &jobQueue{
+		jobs:     make(map[string]*job),
+		maxBytes: maxJobBytes,
+		ch:       make(chan *job, queued),
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// drop drops job "j" (and its result). Must be called with q.mu
+// held.
+func (q *jobQueue) drop(j *job) {
+	delete(q.jobs, j.id)
+	q.bytes -= len(j.png)
+}
+
+// expire drops the jobs that finished more than jobTTL ago. Must be
+// called with q.mu held.
+func (q *jobQueue) expire() {
+	now := time.Now()
+	for _, j := range q.jobs {
+		if !j.finished.IsZero() && now.Sub(j.finished) > jobTTL {
+			q.drop(j)
+		}
+	}
+}
+
+// oldest returns the finished job, other than "skip", that finished
+// first, or nil if there is none. Must be called with q.mu held.
+func (q *jobQueue) oldest(skip *job) *job {
+	var o *job
+	for _, j := range q.jobs {
+		if j == skip || j.finished.IsZero() {
+			continue
+		}
+		if o == nil || j.finished.Before(o.finished) {
+			o = j
+		}
+	}
+	return o
+}
+
+// errJobsFull is returned by submit when no more jobs can be accepted.
+var errJobsFull = errors.New("jobs: Too many jobs")
+
+// submit queues a job rendering the image with parameters "p".
+// Returns the job, or errJobsFull if the queue is full.
+func (q *jobQueue) submit(p *params) (*job, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire()
+	if len(q.jobs) >= maxJobs {
+		// Make room by dropping the oldest finished job
+		o := q.oldest(nil)
+		if o == nil {
+			return nil, errJobsFull
+		}
+		q.drop(o)
+	}
+	j := &job{
+		id:      hex.EncodeToString(b),
+		p:       p,
+		state:   jobQueued,
+		created: time.Now(),
+	}
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	select {
+	case q.ch <- j:
+	default:
+		j.cancel()
+		return nil, errJobsFull
+	}
+	q.jobs[j.id] = j
+	return j, nil
+}
+
+// get returns the job with the given id, or nil if there is no such
+// job.
+func (q *jobQueue) get(id string) *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.jobs[id]
+}
+
+// status returns the status of job "j".
+func (q *jobQueue) status(j *job) jobStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := jobStatus{
+		ID:       j.id,
+		State:    j.state,
+		Progress: 100 * j.progress,
+		Spec:     paramsSpec(j.p),
+		Created:  j.created,
+	}
+	if j.err != nil {
+		st.Error = j.err.Error()
+	}
+	if j.state == jobDone {
+		st.ResultURL = "/jobs/" + j.id + "/result"
+	}
+	if !j.started.IsZero() {
+		t := j.started
+		st.Started = &t
+	}
+	if !j.finished.IsZero() {
+		t := j.finished
+		st.Finished = &t
+	}
+	return st
+}
+
+// result returns the rendered image (PNG-encoded) of job "j", or nil
+// if the job is not done.
+func (q *jobQueue) result(j *job) []byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return j.png
+}
+
+// cancel cancels job "j", if it is queued or running.
+func (q *jobQueue) cancel(j *job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j.state == jobQueued || j.state == jobRunning {
+		j.state = jobCanceled
+		j.finished = time.Now()
+	}
+	j.cancel()
+}
+
+// finish records the outcome of job "j". The state of canceled jobs
+// is not changed. If the results kept exceed q.maxBytes, the oldest
+// finished jobs (other than "j") are dropped.
+func (q *jobQueue) finish(j *job, b []byte, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if j.state == jobCanceled {
+		return
+	}
+	if err != nil {
+		j.state, j.err = jobFailed, err
+	} else {
+		j.state, j.png, j.progress = jobDone, b, 1.0
+		q.bytes += len(b)
+	}
+	j.finished = time.Now()
+	for q.bytes > q.maxBytes {
+		o := q.oldest(j)
+		if o == nil {
+			break
+		}
+		q.drop(o)
+	}
+}
+
+// work runs queued jobs, one at a time.
+func (q *jobQueue) work() {
+	for j := range q.ch {
+		q.mu.Lock()
+		if j.state != jobQueued {
+			q.mu.Unlock()
+			continue
+		}
+		j.state = jobRunning
+		j.started = time.Now()
+		q.mu.Unlock()
+		b, err := q.run(j)
+		q.finish(j, b, err)
+		j.cancel()
+	}
+}
+
+// run renders the image of job "j" (or looks it up in the cache), and
+// returns it PNG-encoded.
+func (q *jobQueue) run(j *job) ([]byte, error) {
+	prog := func(done, total int) {
+		q.mu.Lock()
+		j.progress = float64(done) / float64(total)
+		q.mu.Unlock()
+	}
+	img, _, err := lookupImg(j.ctx, j.p, prog, nil)
+	if err != nil {
+		return nil, err
+	}
+	img = img.Repalette(j.p.palette()).Remap(j.p.colorMap())
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var renderJobs *jobQueue
+
+// jobsHandler serves the jobs API: POST /jobs submits a job (the body
+// is a JSON render spec, see apiRenderHandler), GET /jobs/<id> returns
+// the job's status, GET /jobs/<id>/result returns the rendered image
+// (PNG) once the job is done, and DELETE /jobs/<id> cancels the job.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if path == "" {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			writeAPIErrors(w, http.StatusMethodNotAllowed,
+				fieldErrors{{Error: "method must be POST"}})
+			return
+		}
+		submitJob(w, r)
+		return
+	}
+	id, sub := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		id, sub = path[:i], path[i+1:]
+	}
+	j := renderJobs.get(id)
+	if j == nil || (sub != "" && sub != "result") {
+		writeAPIErrors(w, http.StatusNotFound,
+			fieldErrors{{Error: "no such job"}})
+		return
+	}
+	switch {
+	case sub == "result" && (r.Method == "GET" || r.Method == "HEAD"):
+		b := renderJobs.result(j)
+		if b == nil {
+			writeAPIErrors(w, http.StatusConflict,
+				fieldErrors{{Error: "job not done"}})
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		if r.Method == "GET" {
+			w.Write(b)
+		}
+	case sub == "" && (r.Method == "GET" || r.Method == "HEAD"):
+		writeJSON(w, http.StatusOK, renderJobs.status(j))
+	case sub == "" && r.Method == "DELETE":
+		renderJobs.cancel(j)
+		writeJSON(w, http.StatusOK, renderJobs.status(j))
+	default:
+		if sub == "" {
+			w.Header().Set("Allow", "GET, HEAD, DELETE")
+		} else {
+			w.Header().Set("Allow", "GET, HEAD")
+		}
+		writeAPIErrors(w, http.StatusMethodNotAllowed,
+			fieldErrors{{Error: "method not allowed"}})
+	}
+}
+
+// submitJob submits a job for the render spec posted, and responds
+// with the job's status (and its URL in the Location header).
+func submitJob(w http.ResponseWriter, r *http.Request) {
+	var s renderSpec
+	if fe := decodeJSON(r, &s); fe != nil {
+		writeAPIErrors(w, http.StatusBadRequest, fe)
+		return
+	}
+	p, fe := s.params(r)
+	if fe != nil {
+		writeAPIErrors(w, http.StatusBadRequest, fe)
+		return
+	}
+	if err := admission.check(renderCost(p)); err != nil {
+		writeAPIErrors(w, admitStatus(w, err),
+			fieldErrors{{Error: err.Error()}})
+		return
+	}
+	j, err := renderJobs.submit(p)
+	if err == errJobsFull {
+		writeAPIErrors(w, http.StatusServiceUnavailable,
+			fieldErrors{{Error: err.Error()}})
+		return
+	}
+	if err != nil {
+		writeAPIErrors(w, http.StatusInternalServerError,
+			fieldErrors{{Error: err.Error()}})
+		return
+	}
+	w.Header().Set("Location", "/jobs/"+j.id)
+	writeJSON(w, http.StatusAccepted, renderJobs.status(j))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestJobs(t *testing.T) {
+	saved := imgCache
+	defer func() { imgCache = saved }()
+	imgCache = newCache(1 << 30)
+	q := newJobQueue(1, 4)
+	p := &params{Sx: 320, Sy: 256, Iter: 64,
+		X0: -2.0, Y0: -1.2, X1: 1.0, Y1: 1.2,
+		Pal: "Gray", Palettes: palettes,
+		Map: dflMap, MapFuncs: mapFuncs, PRep: 1, PGam: 1}
+	j, err := q.submit(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st jobStatus
+	for i := 0; i < 100; i++ {
+		st = q.status(j)
+		if st.State == jobDone || st.State == jobFailed {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if st.State != jobDone || st.Progress != 100 {
+		t.Fatalf("job status %+v", st)
+	}
+	img, err := png.Decode(bytes.NewReader(q.result(j)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 320 || img.Bounds().Dy() != 256 {
+		t.Fatalf("result bounds %v", img.Bounds())
+	}
+}
+
+func TestJobsCancel(t *testing.T) {
+	// No workers: Jobs stay queued
+	q := newJobQueue(0, 2)
+	p := &params{Sx: 320, Sy: 256, Iter: 64}
+	j1, err := q.submit(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.submit(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.submit(p); err != errJobsFull {
+		t.Fatalf("full queue: %v", err)
+	}
+	q.cancel(j1)
+	if st := q.status(j1); st.State != jobCanceled {
+		t.Fatalf("canceled job state %s", st.State)
+	}
+	if j1.ctx.Err() == nil {
+		t.Fatal("canceled job context not done")
+	}
+	if q.result(j1) != nil {
+		t.Fatal("canceled job has result")
+	}
+}
+
+func TestJobsLimits(t *testing.T) {
+	// No workers: Jobs are finished by the test
+	q := newJobQueue(0, 2*maxJobs)
+	q.maxBytes = 10
+	p := &params{Sx: 320, Sy: 256, Iter: 64}
+	js := make([]*job, maxJobs)
+	for i := range js {
+		j, err := q.submit(p)
+		if err != nil {
+			t.Fatalf("job %d: %v", i, err)
+		}
+		js[i] = j
+	}
+	// Results over the byte budget: The oldest are dropped
+	for i := 0; i < 3; i++ {
+		q.finish(js[i], make([]byte, 4), nil)
+	}
+	if q.get(js[0].id) != nil || q.get(js[1].id) == nil || q.bytes != 8 {
+		t.Errorf("budget exceeded: %d bytes", q.bytes)
+	}
+	// Finished jobs make room for new ones
+	for i := 0; i < 3; i++ {
+		if _, err := q.submit(p); err != nil {
+			t.Fatalf("finished jobs block the queue: %v", err)
+		}
+	}
+	if q.get(js[2].id) != nil || q.bytes != 0 || len(q.jobs) != maxJobs {
+		t.Errorf("finished jobs kept: %d jobs, %d bytes",
+			len(q.jobs), q.bytes)
+	}
+	// Only queued or running jobs
+	if _, err := q.submit(p); err != errJobsFull {
+		t.Errorf("full queue: %v", err)
+	}
+}
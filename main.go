@@ -1,26 +1,150 @@
 // Command mandel starts a simple web application that renders images
-// of the Mandelbrot Set and serves them over HTTP.
+// of the Mandelbrot Set and serves them over HTTP. It can also render
+// images from the command line.
 //
 // Usage is:
 //
-//     mandel <laddr>
+//     mandel [serve] [flags] <laddr>
+//     mandel render [flags] [-o <file>] [-format <fmt>] [image flags]
+//     mandel batch [flags] <spec file>
+//     mandel zoom [flags] [-end <view> | -center <c> -zoom <range>]
+//         [-frames <n>] [-o <output>] [image flags]
 //
 // Where "<laddr>" is the TCP local network address to listen for HTTP
 // connections to. Example:
 //
 //     mandel :8080
 //
+// The render subcommand renders a single image, and writes it to a
+// file ("-o"; default "mandel.png"; "-": standard output) in PNG, GIF
+// or JPEG format ("-format"; default: from the file's extension). The
+// image flags are the parameters of /mandel: -sx, -sy, -iter, -x0,
+// -y0, -x1, -y1, -pal, -cpal, -poff, -prep, -prev, -pgam, -map, and
+// -con. They are validated the same way: Invalid values are reported
+// and corrected (or, with -strict, rejected). Example:
+//
+//     mandel render -sx 1024 -sy 768 -iter 500 -pal "Gold 1" -o gold.png
+//
+// The batch subcommand renders the images specified in a file ("-":
+// standard input), one per line. Each line is a URL query string with
+// the parameters of /mandel, plus the output file ("out"; default
+// "mandel-<n>.<fmt>") and format ("format"). Empty lines and lines
+// starting with "#" are ignored. Example line:
+//
+//     sx=1024&sy=768&iter=500&pal=Gold+1&out=gold.png
+//
+// The zoom subcommand renders the frames of a zoom animation, from the
+// view given by the image flags to the view given by "-end"
+// ("x0,y0,x1,y1"), or zooming by the factors "-zoom" ("[z0:]z1") into
+// the point "-center" ("x,y"). Frames ("-frames"; default 100) are
+// interpolated so that the zoom proceeds at a steady pace, and the
+// iteration count goes from "-iter" to "-end-iter" (default: 48 more
+// for every doubling of the zoom). They are written as numbered PNG
+// files ("-o"; default "zoom-%05d.png"), an animated GIF, or a raw
+// YUV4MPEG2 (Y4M) stream that can be fed to video encoders ("-o -"
+// writes it to standard output). With "-reuse r", frames are derived
+// from shared keyframes up to r times their size, instead of being
+// rendered one by one. An interrupted run can be continued with
+// "-resume" (PNG and Y4M output). Example:
+//
+//     mandel zoom -sx 640 -sy 360 -center -0.743643,0.131825 \
+//         -zoom 1000 -frames 250 -o - | ffmpeg -i - zoom.mp4
+//
+// The render, batch and zoom subcommands accept the -cache-mem,
+// -cache-dir, -cache-disk, -strict and -render-timeout flags. The
+// serve subcommand (the default) accepts all flags. Flags are:
+//
+//     -cache-mem <MB>
+//         Max memory used by the cache of rendered images (default 512)
+//     -cache-dir <dir>
+//         Directory for the on-disk cache of rendered images (default
+//         none: no on-disk cache)
+//     -cache-disk <MB>
+//         Max disk space used by the on-disk cache (default 4096)
+//     -cache-enc <MB>
+//         Max memory used by the cache of encoded (PNG, GIF) images
+//         (default 128)
+//     -prefetch
+//         Prefetch (render in the background) views adjacent to the
+//         ones requested (default false)
+//     -strict
+//         Reject requests with invalid (unparsable or out-of-range)
+//         parameters with status 400, instead of using corrected
+//         values. Can also be enabled per-request with the "strict"
+//         parameter (default false)
+//     -render-timeout <duration>
+//         Max time to spend rendering an image for a request; if it
+//         expires, the request fails with status 503. Renders also
+//         stop if the client goes away. Does not apply to render
+//         jobs (default 0: no limit)
+//     -max-cost <M iterations>
+//         Max cost of rendering an image, estimated as pixels times
+//         max iterations (not counting iterations already done for
+//         cached images), in millions. Requests for more expensive
+//         images (including render jobs) are rejected with status 400
+//         (default 20000; 0: no limit)
+//     -max-renders <n>
+//         Max number of images being rendered for clients at the
+//         same time; render jobs are not counted (default: number of
+//         CPUs; 0: no limit)
+//     -max-total-cost <M iterations>
+//         Max total cost of the images being rendered for clients at
+//         the same time (default 80000; 0: no limit)
+//     -max-client-renders <n>
+//         Max number of images being rendered (or waiting to be) for
+//         a single client (IP address). More requests are rejected
+//         with status 429 (default 2; 0: no limit)
+//     -admit-wait <duration>
+//         Max time a render waits for others to finish, when the
+//         limits above are reached. Then the request is rejected with
+//         status 503 (default 10s)
+//     -trust-proxy
+//         Identify clients by the first address in the
+//         X-Forwarded-For header, if present, instead of the address
+//         the request came from (default false)
+//     -job-workers <n>
+//         Max number of asynchronous render jobs (see /jobs) running
+//         concurrently (default 2)
+//     -job-queue <n>
+//         Max number of render jobs waiting to run; more are rejected
+//         (default 64)
+//     -admin
+//         Enable the cache statistics and administration page, at
+//         /debug/cache (default false)
+//     -peers <url>,<url>,...
+//         Base URLs (e.g. "http://host:8080") of all the instances
+//         sharing their caches, including this one. Every image is
+//         owned by one of them (chosen by consistent hashing of the
+//         image parameters), which renders and caches it, and
+//         serves it to the others (default none: no sharing)
+//     -self <url>
+//         Base URL of this instance, exactly as listed in -peers
+//     -peer-timeout <duration>
+//         Timeout for fetching images from peers (default 5m)
+//
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"image/color"
 	"image/png"
+	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -49,6 +173,24 @@ const (
 	dflY1 = maxY
 	// Default palette
 	dflPal = "Gray"
+	// Palette offset (fraction of palette length)
+	minPOff = 0.0
+	maxPOff = 1.0
+	dflPOff = 0.0
+	// Palette repeat count
+	minPRep = 1
+	maxPRep = 64
+	dflPRep = 1
+	// Palette gamma
+	minPGam = 0.1
+	maxPGam = 10.0
+	dflPGam = 1.0
+	// Iteration-count mapping function
+	dflMap = "Histogram"
+	// Contrast (for the "Rank" mapping function)
+	minCon = 0.0
+	maxCon = 1.0
+	dflCon = 0.5
 )
 
 var palettes = map[string]color.Palette{
@@ -59,10 +201,36 @@ var palettes = map[string]color.Palette{
 	"Gray":         pal256Gray,
 	"Gray Reverse": pal256GrayR}
 
+// palStops are the color points of the predefined palettes. They are
+// used to initialize the palette editor.
+var palStops = map[string][]colPt{
+	"Blue 1":       pts256Blue1,
+	"Blue 2":       pts256Blue2,
+	"Gold 1":       pts256Gold1,
+	"Gold 2":       pts256Gold2,
+	"Gray":         pts256Gray,
+	"Gray Reverse": pts256GrayR}
+
+var mapFuncs = map[string]mapFunc{
+	"Histogram": mapHisto,
+	"Linear":    mapLinear,
+	"Log":       mapLog,
+	"Sqrt":      mapSqrt,
+	"Modulo":    mapMod,
+	"Rank":      mapRank}
+
 var templates *template.Template
 
 var imgCache *cache
 
+var imgDisk *diskCache
+
+var encImgCache *encCache
+
+var imgPrefetch *prefetcher
+
+var imgPeers *peerRing
+
 func renderTmpl(w http.ResponseWriter, t string, d interface{}) {
 	err := templates.ExecuteTemplate(w, t+".html", d)
 	if err != nil {
@@ -71,123 +239,754 @@ func renderTmpl(w http.ResponseWriter, t string, d interface{}) {
 	}
 }
 
-func valInt(r *http.Request, p string, min, max, dfl int) int {
+// fieldError reports an invalid parameter ("field"). If "field" is
+// empty, the error concerns the request as a whole.
+type fieldError struct {
+	Field string `json:"field,omitempty"`
+	Error string `json:"error"`
+}
+
+// fieldErrors is a list of parameter errors. Errors added to a nil
+// *fieldErrors are discarded.
+type fieldErrors []fieldError
+
+func (fe *fieldErrors) add(field, format string, args ...interface{}) {
+	if fe == nil {
+		return
+	}
+	*fe = append(*fe, fieldError{field, fmt.Sprintf(format, args...)})
+}
+
+// The val* functions parse request parameters. Missing parameters
+// take their default values. Invalid parameters are replaced by their
+// defaults, and out-of-range ones are clamped; in both cases an error
+// is added to "fe", reporting the value used instead.
+
+func valInt(fe *fieldErrors, r *http.Request, p string,
+	min, max, dfl int) int {
 	s := r.FormValue(p)
+	if s == "" {
+		return dfl
+	}
 	v, err := strconv.Atoi(s)
 	if err != nil {
-		v = dfl
-	} else if v < min {
-		v = min
-	} else if v > max {
-		v = max
+		fe.add(p, "invalid value %q; using %d", s, dfl)
+		return dfl
+	}
+	if v < min || v > max {
+		c := min
+		if v > max {
+			c = max
+		}
+		fe.add(p, "%d out of range [%d, %d]; using %d",
+			v, min, max, c)
+		v = c
 	}
 	return v
 }
 
-func valFloat64(r *http.Request, p string,
+func valFloat64(fe *fieldErrors, r *http.Request, p string,
 	min, max, dfl float64) float64 {
 	s := r.FormValue(p)
+	if s == "" {
+		return dfl
+	}
 	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) {
+		fe.add(p, "invalid value %q; using %g", s, dfl)
+		return dfl
+	}
+	if v < min || v > max {
+		c := min
+		if v > max {
+			c = max
+		}
+		fe.add(p, "%g out of range [%g, %g]; using %g",
+			v, min, max, c)
+		v = c
+	}
+	return v
+}
+
+func valBool(fe *fieldErrors, r *http.Request, p string, dfl bool) bool {
+	s := r.FormValue(p)
+	if s == "" {
+		return dfl
+	}
+	v, err := strconv.ParseBool(s)
 	if err != nil {
+		fe.add(p, "invalid value %q; using %t", s, dfl)
 		v = dfl
-	} else if v < min {
-		v = min
-	} else if v > max {
-		v = max
 	}
 	return v
 }
 
-func valPalette(r *http.Request, p string,
+func valPalette(fe *fieldErrors, r *http.Request, p string,
 	valid map[string]color.Palette, dfl string) string {
 	s := r.FormValue(p)
-	_, ok := valid[s]
-	if !ok {
+	if s == "" {
+		return dfl
+	}
+	if _, ok := valid[s]; !ok {
+		fe.add(p, "unknown palette %q; using %q", s, dfl)
+		s = dfl
+	}
+	return s
+}
+
+func valMapFunc(fe *fieldErrors, r *http.Request, p string,
+	valid map[string]mapFunc, dfl string) string {
+	s := r.FormValue(p)
+	if s == "" {
+		return dfl
+	}
+	if _, ok := valid[s]; !ok {
+		fe.add(p, "unknown mapping function %q; using %q", s, dfl)
 		s = dfl
 	}
 	return s
 }
 
+// valPalSpec parses the custom palette specification given as
+// parameter "p". Returns the palette specification (re-formatted in
+// canonical form) and the generated palette. If the parameter is
+// missing or invalid, returns an empty string and a nil palette (and,
+// if invalid, adds an error to "fe").
+func valPalSpec(fe *fieldErrors, r *http.Request,
+	p string) (string, color.Palette) {
+	s := r.FormValue(p)
+	if s == "" {
+		return "", nil
+	}
+	pts, err := parsePalSpec(s, custPalSize)
+	if err != nil {
+		fe.add(p, "%v; ignored", err)
+		return "", nil
+	}
+	pal := make(color.Palette, custPalSize)
+	linGrad(pts, pal)
+	return fmtPalSpec(pts), pal
+}
+
 type params struct {
 	Sx, Sy         int
 	Iter           int
 	X0, Y0, X1, Y1 float64
 	Pal            string
+	CPal           string
+	POff           float64
+	PRep           int
+	PRev           bool
+	PGam           float64
+	Map            string
+	Con            float64
 	Palettes       map[string]color.Palette
+	MapFuncs       map[string]mapFunc
+	// Strict validation: Reject invalid parameters
+	Strict bool
+	// Invalid parameters (replaced by defaults or clamped)
+	Errors fieldErrors
+	// Custom palette, generated from CPal
+	cpal color.Palette
+	// Color points of the available palettes
+	palStops map[string][]colPt
 }
 
 func (p *params) URL() template.URL {
-	s := fmt.Sprintf(
-		"sx=%d&sy=%d&iter=%d&x0=%g&y0=%g&x1=%g&y1=%g&pal=%s",
+	s := fmt.Sprintf("sx=%d&sy=%d&iter=%d&x0=%g&y0=%g&x1=%g&y1=%g&",
 		p.Sx, p.Sy, p.Iter,
-		p.X0, p.Y0, p.X1, p.Y1,
-		p.Pal)
-	return template.URL(s)
+		p.X0, p.Y0, p.X1, p.Y1)
+	return template.URL(s + p.palQuery())
+}
+
+// palQuery returns the palette and color-map parameters of the image,
+// formatted as a URL query string (see URL).
+func (p *params) palQuery() string {
+	s := "pal=" + url.QueryEscape(p.Pal)
+	if p.CPal != "" {
+		s += "&cpal=" + p.CPal
+	}
+	if p.POff != dflPOff {
+		s += fmt.Sprintf("&poff=%g", p.POff)
+	}
+	if p.PRep != dflPRep {
+		s += fmt.Sprintf("&prep=%d", p.PRep)
+	}
+	if p.PRev {
+		s += "&prev=1"
+	}
+	if p.PGam != dflPGam {
+		s += fmt.Sprintf("&pgam=%g", p.PGam)
+	}
+	if p.Map != dflMap {
+		s += "&map=" + p.Map
+	}
+	if p.Con != dflCon {
+		s += fmt.Sprintf("&con=%g", p.Con)
+	}
+	return s
+}
+
+// colorMap returns the color map to render the image with.
+func (p *params) colorMap() colorMap {
+	return colorMap{
+		Func:     p.MapFuncs[p.Map],
+		Contrast: p.Con,
+		Offset:   p.POff,
+		Repeat:   p.PRep,
+		Reverse:  p.PRev,
+		Gamma:    p.PGam,
+	}
+}
+
+// palette returns the palette to render the image with: The custom
+// palette, if one was specified, or the named palette otherwise.
+func (p *params) palette() color.Palette {
+	if p.cpal != nil {
+		return p.cpal
+	}
+	return p.Palettes[p.Pal]
+}
+
+// PalSpec returns the palette specification string (see fmtPalSpec)
+// for the palette the image is rendered with. Used to initialize the
+// palette editor.
+func (p *params) PalSpec() string {
+	if p.CPal != "" {
+		return p.CPal
+	}
+	return fmtPalSpec(p.palStops[p.Pal])
+}
+
+// PalSpecs returns the palette specification strings for all the
+// available palettes, keyed by palette name.
+func (p *params) PalSpecs() map[string]string {
+	m := make(map[string]string, len(p.palStops))
+	for n, pts := range p.palStops {
+		m[n] = fmtPalSpec(pts)
+	}
+	return m
 }
 
 func getParams(r *http.Request) *params {
 	p := &params{}
+	fe := &p.Errors
+	// Parse "strict" (strict validation) parameter
+	p.Strict = valBool(fe, r, "strict", *strict)
 	// Parse "sx" and "sy" (img size) parameters
-	p.Sx = valInt(r, "sx", minSx, maxSx, dflSx)
-	p.Sy = valInt(r, "sy", minSy, maxSy, dflSy)
+	p.Sx = valInt(fe, r, "sx", minSx, maxSx, dflSx)
+	p.Sy = valInt(fe, r, "sy", minSy, maxSy, dflSy)
 	// Parse "iter" (# of iterations) parameter
-	p.Iter = valInt(r, "iter", minIter, maxIter, dflIter)
+	p.Iter = valInt(fe, r, "iter", minIter, maxIter, dflIter)
 	// Parse x0, x1, y0, y1 (coordinates) parameters
-	p.X0 = valFloat64(r, "x0", minX, maxX, dflX0)
-	p.X1 = valFloat64(r, "x1", minX, maxX, dflX1)
-	p.Y0 = valFloat64(r, "y0", minY, maxY, dflY0)
-	p.Y1 = valFloat64(r, "y1", minY, maxY, dflY1)
+	p.X0 = valFloat64(fe, r, "x0", minX, maxX, dflX0)
+	p.X1 = valFloat64(fe, r, "x1", minX, maxX, dflX1)
+	p.Y0 = valFloat64(fe, r, "y0", minY, maxY, dflY0)
+	p.Y1 = valFloat64(fe, r, "y1", minY, maxY, dflY1)
 	// Parse pal (palette name) parameter
-	p.Pal = valPalette(r, "pal", palettes, dflPal)
-	p.Palettes = palettes
+	pals, stops := sessions.palettes(r)
+	p.Pal = valPalette(fe, r, "pal", pals, dflPal)
+	p.Palettes = pals
+	p.palStops = stops
+	// Parse cpal (custom palette specification) parameter
+	p.CPal, p.cpal = valPalSpec(fe, r, "cpal")
+	// Parse poff, prep, prev, pgam (palette transformation)
+	// parameters
+	p.POff = valFloat64(fe, r, "poff", minPOff, maxPOff, dflPOff)
+	if p.POff == maxPOff {
+		p.POff = minPOff
+	}
+	p.PRep = valInt(fe, r, "prep", minPRep, maxPRep, dflPRep)
+	p.PRev = valBool(fe, r, "prev", false)
+	p.PGam = valFloat64(fe, r, "pgam", minPGam, maxPGam, dflPGam)
+	// Parse map (mapping function name) and con (contrast)
+	// parameters
+	p.Map = valMapFunc(fe, r, "map", mapFuncs, dflMap)
+	p.MapFuncs = mapFuncs
+	p.Con = valFloat64(fe, r, "con", minCon, maxCon, dflCon)
 	return p
 }
 
+// activeRenders is the number of images being calculated for
+// clients (i.e. not prefetched). Accessed atomically.
+var activeRenders int32
+
+// getImg returns the image for the given parameters, rendered with
+// the requested palette and color map. The image is looked-up in the
+// cache, and if not found, it is calculated and added to the cache.
+// Returns non-nil error if the image cannot be calculated, or if ctx
+// is done (or the render timeout expires, see renderContext) while
+// calculating the image, or while waiting for it to be calculated by
+// another request.
+func getImg(ctx context.Context, p *params) (*mandelImg, error) {
+	ctx, cancel := renderContext(ctx)
+	defer cancel()
+	img, _, err := lookupImg(ctx, p, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Images from the cache may have a different palette
+	img = img.Repalette(p.palette())
+	return img.Remap(p.colorMap()), nil
+}
+
+// renderContext returns a context derived from ctx, that is canceled
+// when the render timeout (see flag -render-timeout) expires, if one
+// is set.
+func renderContext(ctx context.Context) (context.Context,
+	context.CancelFunc) {
+	if *renderTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, *renderTimeout)
+}
+
+// renderStatus returns the HTTP status code to respond with, when
+// getting an image failed with error "err".
+func renderStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// lookupImg is like getImg, but returns the image as found in the
+// cache (or as calculated), which may have a different palette and
+// color map than the requested ones, and the render timeout is not
+// applied. Prefetching (if in progress) is preempted while the image
+// is calculated. The returned boolean is true if the image was found
+// in the cache. If the image is calculated, the calculation is
+// canceled if ctx is done, and its progress is reported by calling
+// "prog", or, if "pass" is not nil, it is calculated progressively,
+// calling "pass" after each pass (see newMandelImg).
+func lookupImg(ctx context.Context, p *params, prog progressFunc,
+	pass passFunc) (*mandelImg, bool, error) {
+	img, err := imgCache.ReqLookup(ctx, p)
+	if err != nil {
+		return nil, false, err
+	}
+	if img != nil {
+		return img, true, nil
+	}
+	atomic.AddInt32(&activeRenders, 1)
+	if imgPrefetch != nil {
+		imgPrefetch.preempt()
+	}
+	img, err = calcImg(ctx, p, false, prog, pass)
+	atomic.AddInt32(&activeRenders, -1)
+	if err != nil {
+		return nil, false, err
+	}
+	return img, false, nil
+}
+
+// calcImg fetches the image with the given parameters from the peer
+// that owns it, if peers are configured and the image belongs to
+// another peer. Otherwise, or if fetching fails, it calculates the
+// image locally (see calcLocal). Fetched images are added to the
+// in-memory cache (marked as prefetched, if "prefetch" is true), but
+// not to the on-disk cache (the owner keeps them there). It must be
+// called only after a cache lookup for the image returned nil (see
+// cache.ReqLookup). The calculation is canceled if ctx is done, and
+// its progress is reported by calling "prog" or "pass" (see
+// lookupImg).
+func calcImg(ctx context.Context, p *params, prefetch bool,
+	prog progressFunc, pass passFunc) (*mandelImg, error) {
+	if imgPeers != nil {
+		img, err := imgPeers.fetch(ctx, paramsKey(p))
+		if err != nil {
+			log.Printf("Fetch from peer: %v", err)
+		}
+		if img != nil {
+			imgCache.ReqAdd(img, prefetch)
+			return img, nil
+		}
+	}
+	return calcLocal(ctx, p, prefetch, prog, pass)
+}
+
+// calcLocal loads the image with the given parameters from the
+// on-disk cache, or, if not found there, calculates it. Then it adds
+// the image to the caches (marked as prefetched, if "prefetch" is
+// true). It must be called only after a cache lookup for the image
+// returned nil (see cache.ReqLookup). Cancellation and progress are
+// handled as in calcImg. If the image cannot be calculated (or the
+// calculation is canceled), it is abandoned and calcLocal returns
+// non-nil error.
+func calcLocal(ctx context.Context, p *params, prefetch bool,
+	prog progressFunc, pass passFunc) (*mandelImg, error) {
+	var img *mandelImg
+	var err error
+	if imgDisk != nil {
+		// Try the on-disk cache
+		img = imgDisk.load(paramsKey(p))
+		if img != nil {
+			imgCache.ReqAdd(img, prefetch)
+			return img, nil
+		}
+	}
+	// Calculate. Start from an image with lower max iteration
+	// count, if one is cached.
+	if base := imgCache.ReqLookupBase(p); base != nil {
+		img, err = base.refine(ctx, p.Iter, prog)
+	} else {
+		img, err = newMandelImg(ctx, p.Sx, p.Sy, p.palette(),
+			complex(p.X0, p.Y0), complex(p.X1, p.Y1),
+			p.Iter, 100.0, prog, pass)
+	}
+	if err != nil {
+		imgCache.ReqAbandon(p)
+		return nil, err
+	}
+	// Add to caches
+	imgCache.ReqAdd(img, prefetch)
+	if imgDisk != nil {
+		imgDisk.storeAsync(img)
+	}
+	return img, nil
+}
+
+// lookupCover returns an image for the given parameters, rendered
+// with the requested palette and color map, derived from a cached
+// image covering it (see cache.ReqLookupCover), without calculating
+// the set. Returns nil if no such image is cached. The returned
+// boolean is true if the cached image was an exact match for the
+// parameters, and false if the returned image was derived by
+// resampling the cached one.
+func lookupCover(p *params) (*mandelImg, bool) {
+	img := imgCache.ReqLookupCover(p)
+	if img == nil {
+		return nil, false
+	}
+	exact := imgKey(img) == paramsKey(p)
+	if !exact {
+		img = img.resample(p.Sx, p.Sy,
+			complex(p.X0, p.Y0), complex(p.X1, p.Y1))
+	}
+	img = img.Repalette(p.palette())
+	return img.Remap(p.colorMap()), exact
+}
+
+// etag returns the entity tag for the image with the parameters "p".
+// The tag is computed from the canonical image parameters (see URL),
+// the contents of the palette, and the renderer version.
+func (p *params) etag() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n", rendererVersion, p.URL())
+	for _, c := range p.palette() {
+		r, g, b, a := c.RGBA()
+		fmt.Fprintf(h, "%04x%04x%04x%04x", r, g, b, a)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatch returns true if the If-None-Match header value "inm"
+// matches the entity tag "etag" (using weak comparison).
+func etagMatch(inm, etag string) bool {
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// mandelHandler serves images. If the "approx" parameter is set, an
+// image derived from a cached one may be served, instead of
+// calculating the requested one. If the "preview" parameter is set,
+// only cached or derived images are served (the set is never
+// calculated). See serveImg for details.
 func mandelHandler(w http.ResponseWriter, r *http.Request) {
 	p := getParams(r)
-	// Lookup image in cache
-	img := imgCache.ReqLookup(p)
+	preview := valBool(&p.Errors, r, "preview", false)
+	approx := valBool(&p.Errors, r, "approx", false)
+	if p.Strict && p.Errors != nil {
+		paramsError(w, r, p.Errors)
+		return
+	}
+	if serveImg(w, r, p, preview, approx) && imgPrefetch != nil {
+		imgPrefetch.ReqView(p)
+	}
+}
+
+// serveImg serves the image with parameters "p" (PNG-encoded), as
+// requested by "r". If "approx" is true, an image derived from a
+// cached one may be served, instead of calculating the requested
+// one. If "preview" is true, only cached or derived images are served.
+// Header X-Mandel-Result is set to "exact" or "derived" accordingly.
+// Exact images are served with an ETag and conditional requests
+// (If-None-Match) are honored; error responses carry no ETag or
+// cache-expiry headers. HEAD requests are replied without rendering
+// the image. Encoded exact images are cached.
+// Returns true if the image was obtained with getImg (i.e. it was not
+// served from the encoded-images cache, nor derived).
+func serveImg(w http.ResponseWriter, r *http.Request, p *params,
+	preview, approx bool) bool {
+	var etag, encKey string
+	// Cache headers, only for responses with the image
+	cacheable := func() {
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+			cacheForever(w)
+		}
+	}
+	if !preview && !approx {
+		// Image is fully determined by the parameters
+		etag = p.etag()
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			cacheable()
+			w.WriteHeader(http.StatusNotModified)
+			return false
+		}
+		if r.Method == "HEAD" {
+			cacheable()
+			w.Header().Set("Content-Type", "image/png")
+			return false
+		}
+		encKey = "png:" + etag
+		if b := encImgCache.ReqLookup(encKey); b != nil {
+			cacheable()
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("X-Mandel-Result", "exact")
+			w.Write(b)
+			return false
+		}
+	}
+	var img *mandelImg
+	exact, got := true, false
+	if preview || approx {
+		img, exact = lookupCover(p)
+	}
 	if img == nil {
-		// Not found, calculate
-		img, _ = newMandelImg(p.Sx, p.Sy, p.Palettes[p.Pal],
-			complex(p.X0, p.Y0), complex(p.X1, p.Y1),
-			p.Iter, 100.0)
-		// Add to cache
-		imgCache.ReqAdd(img)
+		if preview {
+			http.NotFound(w, r)
+			return false
+		}
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("X-Mandel-Result", "exact")
+			return false
+		}
+		release, err := admitRender(r, p)
+		if err != nil {
+			http.Error(w, err.Error(), admitStatus(w, err))
+			return false
+		}
+		img, err = getImg(r.Context(), p)
+		release()
+		if err != nil {
+			http.Error(w, err.Error(), renderStatus(err))
+			return false
+		}
+		exact, got = true, true
+	}
+	if exact {
+		cacheable()
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if exact {
+		w.Header().Set("X-Mandel-Result", "exact")
 	} else {
-		// Found in cache, just change the palette
-		img = img.Repalette(p.Palettes[p.Pal])
+		w.Header().Set("X-Mandel-Result", "derived")
+		w.Header().Set("Cache-Control", "no-cache")
 	}
-	// Allow client-caching (forever)
+	if r.Method == "HEAD" {
+		return got
+	}
+	// Encode and send image
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	if encKey != "" {
+		encImgCache.ReqAdd(encKey, buf.Bytes())
+	}
+	w.Write(buf.Bytes())
+	return got
+}
+
+// cacheForever sets the response headers that allow clients to cache
+// the response forever (for a year). Only for successful responses
+// that are fully determined by the request's parameters.
+func cacheForever(w http.ResponseWriter) {
 	t := time.Now().Add(365 * 24 * time.Hour)
 	w.Header().Set("Expires", t.Format(http.TimeFormat))
-	// Encode and send image
-	png.Encode(w, img)
 }
 
+// handler serves the main page. Invalid parameters are listed on the
+// page (with the values used instead). In strict mode the page is
+// served with status 400.
 func handler(w http.ResponseWriter, r *http.Request) {
 	p := getParams(r)
+	if p.Strict && p.Errors != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
 	renderTmpl(w, "main", p)
 }
 
+// paramsError responds to a request with invalid parameters (in
+// strict mode) with status 400, listing the errors "fe" as JSON (if
+// the client asked for JSON, see wantJSON) or as text.
+func paramsError(w http.ResponseWriter, r *http.Request, fe fieldErrors) {
+	if wantJSON(r) {
+		writeAPIErrors(w, http.StatusBadRequest, fe)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusBadRequest)
+	for _, e := range fe {
+		fmt.Fprintf(w, "%s: %s\n", e.Field, e.Error)
+	}
+}
+
 func Usage(cmd string) {
-	fmt.Fprintf(os.Stderr, "Usage is: %s <local addr>\n", cmd)
+	fmt.Fprintf(os.Stderr, "Usage is: %s [serve] [flags] <local addr>\n"+
+		"      or: %s render [flags]\n"+
+		"      or: %s batch [flags] <spec file>\n"+
+		"      or: %s zoom [flags]\n",
+		cmd, cmd, cmd, cmd)
+	flag.PrintDefaults()
 }
 
+var cacheMem = flag.Int64("cache-mem", 512,
+	"Max memory used by the cache of rendered images (MB)")
+
+var cacheDir = flag.String("cache-dir", "",
+	"Directory for the on-disk cache of rendered images")
+
+var cacheDisk = flag.Int64("cache-disk", 4096,
+	"Max disk space used by the on-disk cache (MB)")
+
+var cacheEnc = flag.Int64("cache-enc", 128,
+	"Max memory used by the cache of encoded images (MB)")
+
+var prefetch = flag.Bool("prefetch", false,
+	"Prefetch views adjacent to the ones requested")
+
+var strict = flag.Bool("strict", false,
+	"Reject requests with invalid parameters (default: correct them)")
+
+var renderTimeout = flag.Duration("render-timeout", 0,
+	"Max time to render an image for a request (0: no limit)")
+
+var maxCost = flag.Int64("max-cost", 20000,
+	"Max cost of a render, in millions of iterations (0: no limit)")
+
+var maxRenders = flag.Int("max-renders", runtime.NumCPU(),
+	"Max number of renders in progress (0: no limit)")
+
+var maxTotalCost = flag.Int64("max-total-cost", 80000,
+	"Max total cost of renders in progress, in millions of "+
+		"iterations (0: no limit)")
+
+var maxClientRenders = flag.Int("max-client-renders", 2,
+	"Max number of renders in progress per client (0: no limit)")
+
+var admitWait = flag.Duration("admit-wait", 10*time.Second,
+	"Max time a render waits for others to finish")
+
+var trustProxy = flag.Bool("trust-proxy", false,
+	"Identify clients by the X-Forwarded-For header")
+
+var jobWorkers = flag.Int("job-workers", 2,
+	"Max number of render jobs running concurrently")
+
+var jobQueueLen = flag.Int("job-queue", 64,
+	"Max number of render jobs waiting to run")
+
+var admin = flag.Bool("admin", false,
+	"Enable the cache administration page (/debug/cache)")
+
+var peers = flag.String("peers", "",
+	"Comma-separated base URLs of all instances sharing their caches")
+
+var self = flag.String("self", "",
+	"Base URL of this instance, as listed in -peers")
+
+var peerTimeout = flag.Duration("peer-timeout", 5*time.Minute,
+	"Timeout for fetching images from peers")
+
 func main() {
-	if len(os.Args) != 2 {
-		Usage(path.Base(os.Args[0]))
-		os.Exit(1)
+	flag.Usage = func() { Usage(path.Base(os.Args[0])) }
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "serve", "render", "batch", "zoom":
+			cmd, args = args[0], args[1:]
+		}
+	}
+	switch cmd {
+	case "render":
+		os.Exit(renderCmd(args))
+	case "batch":
+		os.Exit(batchCmd(args))
+	case "zoom":
+		os.Exit(zoomCmd(args))
+	}
+	os.Exit(serveCmd(args))
+}
+
+// serveCmd implements the serve subcommand (the default): It starts
+// the web application, listening at the address given.
+func serveCmd(args []string) int {
+	flag.CommandLine.Parse(args)
+	if flag.NArg() != 1 {
+		flag.Usage()
+		return 2
+	}
+	if err := initCaches(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *prefetch {
+		imgPrefetch = newPrefetcher()
+	}
+	renderJobs = newJobQueue(*jobWorkers, *jobQueueLen)
+	admission = newAdmitter(admitLimits{
+		MaxCost:          *maxCost,
+		MaxRenders:       *maxRenders,
+		MaxTotalCost:     *maxTotalCost,
+		MaxClientRenders: *maxClientRenders,
+		MaxWait:          admitWait.Seconds(),
+	})
+	if *peers != "" {
+		var err error
+		imgPeers, err = newPeerRing(*self,
+			strings.Split(*peers, ","), *peerTimeout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
 	}
-	imgCache = newCache()
 	templates = parseEntries(_bundleIdx, "templates/", ".html")
 	http.Handle("/js/", serveEntries(_bundleIdx, "js/", "/js/"))
 	http.Handle("/css/", serveEntries(_bundleIdx, "css/", "/css/"))
 	http.HandleFunc("/mandel", mandelHandler)
+	http.HandleFunc("/mandel/stream", streamHandler)
+	http.HandleFunc("/tiles/", tileHandler)
+	http.HandleFunc("/map", mapHandler)
+	http.HandleFunc("/dzi/", dziHandler)
+	http.HandleFunc("/iiif/", iiifHandler)
+	http.HandleFunc("/anim", animHandler)
+	http.HandleFunc("/palette/extract", extractHandler)
+	http.HandleFunc("/api/v1/render", apiRenderHandler)
+	http.HandleFunc("/jobs", jobsHandler)
+	http.HandleFunc("/jobs/", jobsHandler)
+	http.HandleFunc("/api/v1/palettes", apiPalettesHandler)
+	http.HandleFunc("/api/v1/limits", apiLimitsHandler)
+	http.Handle("/api/v1/openapi.json",
+		serveEntries(_bundleIdx, "api/", "/api/v1/"))
+	if imgPeers != nil {
+		http.HandleFunc(peerPath, peerHandler)
+	}
+	if *admin {
+		http.HandleFunc("/debug/cache", cacheAdminHandler)
+	}
 	http.HandleFunc("/", handler)
-	err := http.ListenAndServe(os.Args[1], nil)
+	err := http.ListenAndServe(flag.Arg(0), nil)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return 1
 	}
+	return 0
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestETag(t *testing.T) {
+	p := &params{Sx: 640, Sy: 512, Iter: 64,
+		X0: -2.0, Y0: -1.2, X1: 1.0, Y1: 1.2,
+		Pal: "Gray", Palettes: palettes}
+	e := p.etag()
+	if e != p.etag() {
+		t.Fatal("etag not stable")
+	}
+	p.Pal = "Gray Reverse"
+	if p.etag() == e {
+		t.Fatal("etag does not depend on palette")
+	}
+	p.Pal = "Gray"
+	p.Iter = 65
+	if p.etag() == e {
+		t.Fatal("etag does not depend on parameters")
+	}
+	var tests = []struct {
+		inm   string
+		match bool
+	}{
+		{"", false},
+		{"*", true},
+		{e, true},
+		{"W/" + e, true},
+		{`"foo", ` + e, true},
+		{`"foo", "bar"`, false},
+	}
+	p.Iter = 64
+	for _, tt := range tests {
+		if etagMatch(tt.inm, p.etag()) != tt.match {
+			t.Fatalf("etagMatch(%q) != %v", tt.inm, tt.match)
+		}
+	}
+}
+
+func TestGetParams(t *testing.T) {
+	tests := []struct {
+		query  string
+		fields []string
+	}{
+		{"", nil},
+		{"sx=800&iter=500&pal=Gold+1&map=Log", nil},
+		{"sx=10&iter=1000000", []string{"sx", "iter"}},
+		{"x0=foo&y1=NaN", []string{"x0", "y1"}},
+		{"pal=Nope&map=Nope&prev=maybe", []string{"pal", "prev", "map"}},
+		{"cpal=0:zzzzzz", []string{"cpal"}},
+		{"strict=1&sx=10", []string{"sx"}},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("GET", "/?"+tc.query, nil)
+		p := getParams(r)
+		if len(p.Errors) != len(tc.fields) {
+			t.Errorf("%s: errors %v, want fields %v",
+				tc.query, p.Errors, tc.fields)
+			continue
+		}
+		for i := range p.Errors {
+			if p.Errors[i].Field != tc.fields[i] {
+				t.Errorf("%s: error %d field %q, want %q", tc.query,
+					i, p.Errors[i].Field, tc.fields[i])
+			}
+		}
+	}
+	// Non-strict: values are corrected
+	r := httptest.NewRequest("GET", "/?sx=10&iter=foo", nil)
+	p := getParams(r)
+	if p.Strict || p.Sx != minSx || p.Iter != dflIter {
+		t.Errorf("corrected params: strict %v, sx %d, iter %d",
+			p.Strict, p.Sx, p.Iter)
+	}
+	// Strict: request is rejected
+	w := httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/mandel?strict=1&sx=10&iter=foo", nil)
+	mandelHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("strict: status %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "sx: ") ||
+		!strings.Contains(w.Body.String(), "iter: ") {
+		t.Fatalf("strict: body %q", w.Body)
+	}
+}
+
+func TestRenderTimeout(t *testing.T) {
+	saved, savedTimeout := imgCache, *renderTimeout
+	defer func() { imgCache, *renderTimeout = saved, savedTimeout }()
+	imgCache = newCache(1 << 30)
+	*renderTimeout = time.Millisecond
+	p := &params{Sx: 2048, Sy: 2048, Iter: maxIter,
+		X0: -2.0, Y0: -1.2, X1: 1.0, Y1: 1.2,
+		Pal: "Gray", Palettes: palettes}
+	_, err := getImg(context.Background(), p)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err %v", err)
+	}
+	if renderStatus(err) != http.StatusServiceUnavailable {
+		t.Fatalf("status %d", renderStatus(err))
+	}
+	// No partial image cached, and no flight left behind
+	st := imgCache.ReqStats()
+	if len(st.Entries) != 0 || st.Flights != 0 {
+		t.Fatalf("entries %d, flights %d", len(st.Entries), st.Flights)
+	}
+}
+
+func TestServeImgHeaders(t *testing.T) {
+	saved, savedEnc := imgCache, encImgCache
+	defer func() { imgCache, encImgCache = saved, savedEnc }()
+	imgCache = newCache(1 << 30)
+	encImgCache = newEncCache(1 << 20)
+	p := &params{Sx: 64, Sy: 48, Iter: 32,
+		X0: -2.0, Y0: -1.2, X1: 1.0, Y1: 1.2,
+		Pal: "Gray", Palettes: palettes}
+	// HEAD, exact or approximate (not cached): Not rendered
+	for _, approx := range []bool{false, true} {
+		r := httptest.NewRequest("HEAD", "/mandel", nil)
+		w := httptest.NewRecorder()
+		serveImg(w, r, p, false, approx)
+		if w.Code != http.StatusOK ||
+			w.Header().Get("Content-Type") != "image/png" ||
+			(w.Header().Get("ETag") != "") == approx {
+			t.Errorf("HEAD, approx %v: status %d, headers %v",
+				approx, w.Code, w.Header())
+		}
+		if st := imgCache.ReqStats(); len(st.Entries) != 0 {
+			t.Fatalf("HEAD, approx %v: image rendered", approx)
+		}
+	}
+	// Render fails: No cache headers
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", "/mandel", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	serveImg(w, r, p, false, false)
+	if w.Code == http.StatusOK || w.Header().Get("ETag") != "" ||
+		w.Header().Get("Expires") != "" {
+		t.Fatalf("error: status %d, headers %v", w.Code, w.Header())
+	}
+	r = httptest.NewRequest("GET", "/mandel", nil)
+	w = httptest.NewRecorder()
+	serveImg(w, r, p, false, false)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != p.etag() ||
+		w.Header().Get("Expires") == "" {
+		t.Fatalf("status %d, headers %v", w.Code, w.Header())
+	}
+	r.Header.Set("If-None-Match", p.etag())
+	w = httptest.NewRecorder()
+	serveImg(w, r, p, false, false)
+	if w.Code != http.StatusNotModified ||
+		w.Header().Get("ETag") != p.etag() {
+		t.Fatalf("conditional: status %d, headers %v",
+			w.Code, w.Header())
+	}
+}
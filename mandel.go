@@ -3,12 +3,69 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"image"
 	"image/color"
+	"math"
 	"math/cmplx"
+	"sort"
+	"strconv"
 )
 
+// rendererVersion identifies the rendering algorithm. It must be
+// incremented whenever the algorithm changes in ways that change the
+// rendered images. Doing so invalidates images cached by clients.
+const rendererVersion = 1
+
+// mapFunc selects the function used to map (normalize) the
+// iteration counts of the image pixels to the range [0.0 .. 1.0],
+// before mapping them to palette slots.
+type mapFunc int
+
+const (
+	// Cumulative histogram (histogram coloring)
+	mapHisto mapFunc = iota
+	// Linear: iter / MaxIter
+	mapLinear
+	// Logarithmic: log(1 + iter) / log(MaxIter)
+	mapLog
+	// Square root: sqrt(iter / MaxIter)
+	mapSqrt
+	// Modulo palette length (cyclic)
+	mapMod
+	// Rank of the iteration count among the iteration counts
+	// present in the image, blended with the cumulative histogram
+	// according to colorMap.Contrast
+	mapRank
+)
+
+// colorMap specifies how the (normalized) iteration counts of the
+// image pixels are mapped to palette slots. The zero value maps the
+// iteration counts to the palette unchanged.
+type colorMap struct {
+	// Iteration-count normalization function
+	Func mapFunc
+	// Contrast for mapRank, in the range [0.0 .. 1.0]: Zero
+	// spreads the iteration counts present in the image evenly
+	// across the palette, 1.0 is the same as mapHisto
+	Contrast float64
+	// Palette offset (rotation) as a fraction of the palette
+	// length, in the range [0.0 .. 1.0)
+	Offset float64
+	// Number of times the palette is repeated (cycled) across
+	// the iteration range. Zero is the same as 1
+	Repeat int
+	// Traverse the palette in reverse
+	Reverse bool
+	// Gamma exponent applied to the normalized iteration
+	// count. Zero is the same as 1.0
+	Gamma float64
+	// Use the cyclic mapping (see palIndex) even with no offset
+	// or repeat, so that rotating the palette is smooth
+	Cyclic bool
+}
+
 // mandelImg is a Mandelbrot-set image. It implements the image.Image
 // interface.
 type mandelImg struct {
@@ -20,6 +77,8 @@ type mandelImg struct {
 	Radius float64
 	// Palette used to map pixels to colors
 	Palette color.Palette
+	// Mapping of iteration counts to palette slots
+	CMap colorMap
 	// Width & Height in pixels
 	w, h int
 	// Pixel array. Keeps iteration-count for every pixel
@@ -29,12 +88,44 @@ type mandelImg struct {
 	// Cummulative-normalized histogram: cnhisto[i] is # of pixels
 	// with iterations <= i, mapped to [0.0 .. 1.0]
 	cnhisto []float64
+	// Rank-normalized histogram: rnhisto[i] is # of distinct
+	// iteration counts <= i present in the image, mapped to [0.0
+	// .. 1.0]
+	rnhisto []float64
+	// Final z values of the pixels that did not escape (with
+	// iteration-count == MaxIter), in pix-array order. Used to
+	// resume iteration for these pixels, when refining the image
+	// (see refine). Nil if not available.
+	zs []complex128
 }
 
+// ctxPix is the number of pixels (of a row) calculated between checks
+// for cancellation. The context is also checked before each row.
+const ctxPix = 1024
+
+// passStrides are the strides of the passes of progressive
+// calculations (see calcPasses), coarsest first.
+var passStrides = []int{8, 4, 2, 1}
+
+// passFunc is called after each pass, but the last, of a progressive
+// calculation (see calcPasses), with the pixels calculated so far
+// (see subsample), and the pass's stride.
+type passFunc func(m *mandelImg, stride int)
+
+// progressFunc is called periodically while an image is calculated,
+// with the number of image rows done, and the total number of rows.
+type progressFunc func(done, total int)
+
 // NewMandel calculates and returns a new Mandelbrot-set
-// image. Returns non-nil error if invalid parameters are given.
-func newMandelImg(width, height int, p color.Palette, c0, c1 complex128,
-	iter int, radius float64) (*mandelImg, error) {
+// image. Progress is reported by calling "prog" (if not nil) after
+// each row of pixels. If "pass" is not nil, the image is calculated
+// progressively instead (see calcPasses), calling "pass" after each
+// pass, and "prog" is not called. Returns non-nil error if invalid
+// parameters are given, or if ctx is done before the image is
+// calculated.
+func newMandelImg(ctx context.Context, width, height int,
+	p color.Palette, c0, c1 complex128, iter int, radius float64,
+	prog progressFunc, pass passFunc) (*mandelImg, error) {
 	if iter <= 0 || radius <= 0 || width <= 0 || height <= 0 {
 		err := errors.New("newMandelImg: Invalid parameters")
 		return nil, err
@@ -49,7 +140,17 @@ func newMandelImg(width, height int, p color.Palette, c0, c1 complex128,
 	m.pix = make([]int, width*height)
 	m.histo = make([]int, iter+1)
 	m.cnhisto = make([]float64, iter)
-	m.calcPix()
+	m.rnhisto = make([]float64, iter)
+	m.zs = []complex128{}
+	var err error
+	if pass != nil {
+		err = m.calcPasses(ctx, pass)
+	} else {
+		err = m.calcPix(ctx, prog)
+	}
+	if err != nil {
+		return nil, err
+	}
 	m.calcHisto()
 	return m, nil
 }
@@ -64,16 +165,78 @@ func (m *mandelImg) At(x, y int) color.Color {
 	if !m.pixIn(x, y) {
 		return color.RGBA{}
 	}
-	iter := m.pix[m.pixOffset(x, y)]
+	return m.Palette[m.colorIndex(m.pixOffset(x, y))]
+}
+
+// colorIndex returns the index of the palette color for the pixel at
+// pix-array offset "of".
+func (m *mandelImg) colorIndex(of int) int {
+	iter := m.pix[of]
 	if iter == m.MaxIter {
-		return m.Palette[0]
+		return 0
 	} else {
+		return m.palIndex(m.norm(iter))
+	}
+}
+
+// norm maps the iteration count "iter" (which must be < MaxIter) to
+// the range [0.0 .. 1.0], using the image's normalization function.
+func (m *mandelImg) norm(iter int) float64 {
+	max := float64(m.MaxIter - 1)
+	if max <= 0 {
+		return 0
+	}
+	switch m.CMap.Func {
+	case mapLinear:
+		return float64(iter) / max
+	case mapLog:
+		return math.Log1p(float64(iter)) / math.Log1p(max)
+	case mapSqrt:
+		return math.Sqrt(float64(iter) / max)
+	case mapMod:
 		l := len(m.Palette)
-		idx := int(m.cnhisto[iter] * float64(l-1))
-		return m.Palette[idx]
+		if l <= 1 {
+			return 0
+		}
+		return float64(iter%l) / float64(l-1)
+	case mapRank:
+		c := m.CMap.Contrast
+		return (1-c)*m.rnhisto[iter] + c*m.cnhisto[iter]
+	default:
+		return m.cnhisto[iter]
 	}
 }
 
+// palIndex maps the normalized iteration count "v" (in the range
+// [0.0 .. 1.0]) to a palette slot, according to the image's color
+// map. With an offset or repeat (or if the map is Cyclic), the
+// mapping wraps around the end of the palette; otherwise "v" is
+// spread over the palette from the first to the last slot. Returns
+// the index of the palette slot.
+func (m *mandelImg) palIndex(v float64) int {
+	cm := &m.CMap
+	l := len(m.Palette)
+	if cm.Gamma > 0 && cm.Gamma != 1 {
+		v = math.Pow(v, cm.Gamma)
+	}
+	var idx int
+	if cm.Repeat > 1 || cm.Offset != 0 || cm.Cyclic {
+		// Cyclic mapping: Wrap around the end of the palette
+		if cm.Repeat > 1 {
+			v *= float64(cm.Repeat)
+		}
+		v += cm.Offset
+		v -= math.Floor(v)
+		idx = int(v*float64(l)) % l
+	} else {
+		idx = int(v * float64(l-1))
+	}
+	if cm.Reverse {
+		idx = l - 1 - idx
+	}
+	return idx
+}
+
 // Opaque scans the image's palette and returns true if all colors are
 // fully opaque.
 func (m *mandelImg) Opaque() bool {
@@ -86,6 +249,17 @@ func (m *mandelImg) Opaque() bool {
 	return true
 }
 
+// Size returns the (approximate) size of the image's data (pixel and
+// histogram arrays) in bytes.
+func (m *mandelImg) Size() int64 {
+	const intSize = strconv.IntSize / 8
+	const float64Size = 8
+	const complex128Size = 16
+	return int64(len(m.pix)+len(m.histo))*intSize +
+		int64(len(m.cnhisto)+len(m.rnhisto))*float64Size +
+		int64(len(m.zs))*complex128Size
+}
+
 // setIter sets the iteration count for the pixel at the given
 // coordinates to "iter". It also updates the histogram by
 // incrementing histo[iter].
@@ -115,28 +289,234 @@ func (m *mandelImg) pixIn(x, y int) bool {
 	return x >= 0 && x < m.w && y >= 0 && y < m.h
 }
 
-// calcPix calculates pixel values for the image as well as the image
-// histogram.
-func (m *mandelImg) calcPix() {
-	// Deltas for stepping on the complex plane
+// pixC returns the point on the complex plane (world coordinates)
+// that corresponds to the pixel at the given (viewport) coordinates.
+func (m *mandelImg) pixC(px, py int) complex128 {
 	dx := (real(m.C1) - real(m.C0)) / float64(m.w)
 	dy := (imag(m.C1) - imag(m.C0)) / float64(m.h)
-	// x, y are on the complex plane (world coordinates)
+	return complex(real(m.C0)+float64(px)*dx,
+		imag(m.C0)+float64(py)*dy)
+}
+
+// iterate iterates z = z*z + c, starting with the given z and
+// iteration count "i", until z escapes or the iteration count reaches
+// MaxIter. Returns the final iteration count and z.
+func (m *mandelImg) iterate(c, z complex128, i int) (int, complex128) {
+	for ; i < m.MaxIter; i++ {
+		z = z*z + c
+		if cmplx.Abs(z) > m.Radius {
+			break
+		}
+	}
+	return i, z
+}
+
+// calcPix calculates pixel values for the image as well as the image
+// histogram. Progress is reported by calling "prog" (if not nil) after
+// each row. Returns ctx.Err() if ctx is done before all pixels are
+// calculated (ctx is checked before each row, and every ctxPix pixels
+// in a row).
+func (m *mandelImg) calcPix(ctx context.Context, prog progressFunc) error {
 	// px, py are on the image (viewport coordinates)
-	for y, py := imag(m.C0), 0; py < m.h; y, py = y+dy, py+1 {
-		for x, px := real(m.C0), 0; px < m.w; x, px = x+dx, px+1 {
-			c := complex(x, y)
-			z := complex(0, 0)
-			var i = 0
-			for i = 0; i < m.MaxIter; i++ {
-				z = z*z + c
-				if cmplx.Abs(z) > m.Radius {
-					break
+	for py := 0; py < m.h; py++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for px := 0; px < m.w; px++ {
+			if px > 0 && px%ctxPix == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
 				}
 			}
+			i, z := m.iterate(m.pixC(px, py), 0, 0)
+			if i == m.MaxIter {
+				m.zs = append(m.zs, z)
+			}
 			m.setIter(px, py, i)
 		}
+		if prog != nil {
+			prog(py+1, m.h)
+		}
+	}
+	return nil
+}
+
+// calcPasses is like calcPix, but calculates the pixels in passes of
+// decreasing stride (see passStrides): A pass with stride "s"
+// calculates the pixels whose coordinates are multiples of "s",
+// except for those already calculated by the previous pass. After
+// each pass but the last, "pass" is called. The final z values are
+// stored in the same order as by calcPix.
+func (m *mandelImg) calcPasses(ctx context.Context, pass passFunc) error {
+	type pixZ struct {
+		of int
+		z  complex128
+	}
+	var zs []pixZ
+	prev := 0
+	for _, s := range passStrides {
+		for py := 0; py < m.h; py += s {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			for px := 0; px < m.w; px += s {
+				if px > 0 && px%ctxPix == 0 {
+					if err := ctx.Err(); err != nil {
+						return err
+					}
+				}
+				if prev != 0 && px%prev == 0 && py%prev == 0 {
+					continue
+				}
+				i, z := m.iterate(m.pixC(px, py), 0, 0)
+				if i == m.MaxIter {
+					zs = append(zs, pixZ{m.pixOffset(px, py), z})
+				}
+				m.setIter(px, py, i)
+			}
+		}
+		prev = s
+		if s > 1 {
+			pass(m.subsample(s), s)
+		}
+	}
+	sort.Slice(zs, func(i, j int) bool { return zs[i].of < zs[j].of })
+	for _, pz := range zs {
+		m.zs = append(m.zs, pz.z)
+	}
+	return nil
+}
+
+// subsample returns a new image, made of every stride-th pixel of "m"
+// in both directions (i.e. of size m.w/stride x m.h/stride, rounded
+// up), with the same domain, max iteration count, palette, and color
+// map. The new image's final z values are not available.
+func (m *mandelImg) subsample(stride int) *mandelImg {
+	ms := &mandelImg{}
+	ms.C0, ms.C1 = m.C0, m.C1
+	ms.MaxIter = m.MaxIter
+	ms.Radius = m.Radius
+	ms.Palette = m.Palette
+	ms.CMap = m.CMap
+	ms.w = (m.w + stride - 1) / stride
+	ms.h = (m.h + stride - 1) / stride
+	ms.pix = make([]int, ms.w*ms.h)
+	ms.histo = make([]int, m.MaxIter+1)
+	ms.cnhisto = make([]float64, m.MaxIter)
+	ms.rnhisto = make([]float64, m.MaxIter)
+	for py := 0; py < ms.h; py++ {
+		for px := 0; px < ms.w; px++ {
+			i := m.pix[m.pixOffset(px*stride, py*stride)]
+			ms.setIter(px, py, i)
+		}
+	}
+	ms.calcHisto()
+	return ms
+}
+
+// refine creates a new image, identical to "m" but with a higher max
+// iteration count ("iter"). Iteration resumes only for the pixels of
+// "m" that did not escape; the iteration counts of the other pixels
+// are copied from "m". The new image has its own pixel and histogram
+// arrays. Progress and cancellation are handled as in calcPix.
+// Returns non-nil error if "iter" is not higher than m's max iteration
+// count, if m's final z values are not available, or if ctx is done
+// before the new image is calculated.
+func (m *mandelImg) refine(ctx context.Context, iter int,
+	prog progressFunc) (*mandelImg, error) {
+	if iter <= m.MaxIter || m.zs == nil {
+		err := errors.New("refine: Cannot refine image")
+		return nil, err
+	}
+	mn := &mandelImg{}
+	mn.C0, mn.C1 = m.C0, m.C1
+	mn.MaxIter = iter
+	mn.Radius = m.Radius
+	mn.Palette = m.Palette
+	mn.CMap = m.CMap
+	mn.w, mn.h = m.w, m.h
+	mn.pix = make([]int, len(m.pix))
+	mn.histo = make([]int, iter+1)
+	mn.cnhisto = make([]float64, iter)
+	mn.rnhisto = make([]float64, iter)
+	mn.zs = []complex128{}
+	k := 0
+	for py := 0; py < m.h; py++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for px := 0; px < m.w; px++ {
+			if px > 0 && px%ctxPix == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+			}
+			i := m.pix[m.pixOffset(px, py)]
+			if i == m.MaxIter {
+				var z complex128
+				i, z = mn.iterate(m.pixC(px, py), m.zs[k], i)
+				k++
+				if i == mn.MaxIter {
+					mn.zs = append(mn.zs, z)
+				}
+			}
+			mn.setIter(px, py, i)
+		}
+		if prog != nil {
+			prog(py+1, m.h)
+		}
 	}
+	mn.calcHisto()
+	return mn, nil
+}
+
+// resample creates a new image of the given size, covering the
+// domain [c0 .. c1], by sampling the pixels of image "m" (using the
+// nearest pixel of "m" for every pixel of the new image). The domain
+// should be inside the domain of "m", and the new image should have
+// equal or lower pixel density than "m"; otherwise the new image will
+// be inaccurate. The new image has the same palette, color map, max
+// iteration count, and escape radius as "m", and its own pixel and
+// histogram arrays. Returns a pointer to the new image.
+func (m *mandelImg) resample(width, height int,
+	c0, c1 complex128) *mandelImg {
+	mn := &mandelImg{}
+	mn.C0, mn.C1 = c0, c1
+	mn.MaxIter = m.MaxIter
+	mn.Radius = m.Radius
+	mn.Palette = m.Palette
+	mn.CMap = m.CMap
+	mn.w, mn.h = width, height
+	mn.pix = make([]int, width*height)
+	mn.histo = make([]int, m.MaxIter+1)
+	mn.cnhisto = make([]float64, m.MaxIter)
+	mn.rnhisto = make([]float64, m.MaxIter)
+	// Deltas for stepping on the complex plane, for the new (d)
+	// and the original (md) image
+	dx := (real(c1) - real(c0)) / float64(width)
+	dy := (imag(c1) - imag(c0)) / float64(height)
+	mdx := (real(m.C1) - real(m.C0)) / float64(m.w)
+	mdy := (imag(m.C1) - imag(m.C0)) / float64(m.h)
+	clamp := func(v, max int) int {
+		if v < 0 {
+			return 0
+		} else if v >= max {
+			return max - 1
+		}
+		return v
+	}
+	for py := 0; py < height; py++ {
+		y := imag(c0) + float64(py)*dy
+		my := clamp(int(math.Floor((y-imag(m.C0))/mdy+0.5)), m.h)
+		for px := 0; px < width; px++ {
+			x := real(c0) + float64(px)*dx
+			mx := clamp(int(math.Floor((x-real(m.C0))/mdx+0.5)),
+				m.w)
+			mn.setIter(px, py, m.pix[m.pixOffset(mx, my)])
+		}
+	}
+	mn.calcHisto()
+	return mn
 }
 
 // calcHisto calculates the cumulative-normalized histogram for the
@@ -161,6 +541,19 @@ func (m *mandelImg) calcHisto() {
 	for i := 0; i < m.MaxIter; i++ {
 		m.cnhisto[i] /= float64(total)
 	}
+	// Calculate rank histogram: rnhisto[i] is # of distinct
+	// iteration counts <= i (again, excluding MaxIter) present in
+	// the image. Then normalize it.
+	ranks := 0
+	for i := 0; i < m.MaxIter; i++ {
+		if m.histo[i] != 0 {
+			ranks++
+		}
+		m.rnhisto[i] = float64(ranks)
+	}
+	for i := 0; i < m.MaxIter; i++ {
+		m.rnhisto[i] /= float64(ranks)
+	}
 }
 
 // Repalette creates a copy of the image with a different palette and
@@ -172,3 +565,12 @@ func (m *mandelImg) Repalette(p color.Palette) *mandelImg {
 	mn.Palette = p
 	return &mn
 }
+
+// Remap creates a copy of the image with a different color map and
+// returns a pointer to it. Like with Repalette, the two images share
+// the same data.
+func (m *mandelImg) Remap(cm colorMap) *mandelImg {
+	mn := *m
+	mn.CMap = cm
+	return &mn
+}
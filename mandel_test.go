@@ -1,10 +1,13 @@
 package main
 
-import "testing"
+import (
+	"context"
+	"testing"
+)
 
 func TestMandel(t *testing.T) {
-	m, err := newMandelImg(160, 120, pal256Gray,
-		complex(-2.0, -1.2), complex(1.0, 1.2), 16, 2)
+	m, err := newMandelImg(context.Background(), 160, 120, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 16, 2, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -23,3 +26,229 @@ func TestMandel(t *testing.T) {
 			v, int(float64(l)*v))
 	}
 }
+
+func TestMandelCancel(t *testing.T) {
+	rows := 0
+	prog := func(done, total int) {
+		if done != rows+1 || total != 120 {
+			t.Fatalf("progress %d/%d after %d rows", done, total, rows)
+		}
+		rows = done
+	}
+	_, err := newMandelImg(context.Background(), 160, 120, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 16, 2, prog, nil)
+	if err != nil || rows != 120 {
+		t.Fatalf("rows %d, err %v", rows, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rows = 0
+	prog = func(done, total int) {
+		rows = done
+		if done == 10 {
+			cancel()
+		}
+	}
+	m, err := newMandelImg(ctx, 160, 120, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 16, 2, prog, nil)
+	if m != nil || err != context.Canceled || rows != 10 {
+		t.Fatalf("canceled: m %v, rows %d, err %v", m != nil, rows, err)
+	}
+}
+
+func TestCalcPasses(t *testing.T) {
+	// Not a multiple of the coarsest stride
+	const w, h = 163, 122
+	mc, err := newMandelImg(context.Background(), w, h, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 64, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var strides []int
+	pass := func(m *mandelImg, stride int) {
+		strides = append(strides, stride)
+		sw, sh := (w+stride-1)/stride, (h+stride-1)/stride
+		if m.w != sw || m.h != sh {
+			t.Fatalf("stride %d: size %dx%d", stride, m.w, m.h)
+		}
+		for py := 0; py < sh; py++ {
+			for px := 0; px < sw; px++ {
+				v := m.pix[m.pixOffset(px, py)]
+				vc := mc.pix[mc.pixOffset(px*stride, py*stride)]
+				if v != vc {
+					t.Fatalf("stride %d: pixel %d,%d: %d != %d",
+						stride, px, py, v, vc)
+				}
+			}
+		}
+	}
+	m, err := newMandelImg(context.Background(), w, h, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 64, 2, nil, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(strides) != 3 || strides[0] != 8 || strides[2] != 2 {
+		t.Fatalf("strides %v", strides)
+	}
+	for i := range mc.pix {
+		if m.pix[i] != mc.pix[i] {
+			t.Fatalf("pixel %d: %d != %d", i, m.pix[i], mc.pix[i])
+		}
+	}
+	for i := range mc.histo {
+		if m.histo[i] != mc.histo[i] {
+			t.Fatalf("histo %d: %d != %d", i, m.histo[i], mc.histo[i])
+		}
+	}
+	if len(m.zs) != len(mc.zs) {
+		t.Fatalf("zs len %d != %d", len(m.zs), len(mc.zs))
+	}
+	for i := range mc.zs {
+		if m.zs[i] != mc.zs[i] {
+			t.Fatalf("zs %d: %v != %v", i, m.zs[i], mc.zs[i])
+		}
+	}
+}
+
+func TestPalIndex(t *testing.T) {
+	m := &mandelImg{Palette: pal256Gray}
+	var tests = []struct {
+		cm  colorMap
+		v   float64
+		idx int
+	}{
+		{colorMap{}, 0.0, 0},
+		{colorMap{}, 0.5, 127},
+		{colorMap{}, 1.0, 255},
+		{colorMap{Reverse: true}, 0.0, 255},
+		{colorMap{Reverse: true}, 1.0, 0},
+		{colorMap{Offset: 0.5}, 0.0, 128},
+		{colorMap{Offset: 0.5}, 0.5, 0},
+		{colorMap{Repeat: 2}, 0.25, 128},
+		{colorMap{Repeat: 2}, 0.5, 0},
+		{colorMap{Cyclic: true}, 0.5, 128},
+		{colorMap{Cyclic: true}, 1.0, 0},
+		{colorMap{Gamma: 2}, 0.5, 63},
+		{colorMap{Gamma: 1}, 0.5, 127},
+	}
+	for i, tt := range tests {
+		m.CMap = tt.cm
+		if idx := m.palIndex(tt.v); idx != tt.idx {
+			t.Fatalf("%d: palIndex(%f) = %d, want %d",
+				i, tt.v, idx, tt.idx)
+		}
+	}
+}
+
+func TestNorm(t *testing.T) {
+	m, err := newMandelImg(context.Background(), 160, 120, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 64, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.rnhisto) != 64 {
+		t.Fatalf("Bad rnhisto len: %v", len(m.rnhisto))
+	}
+	fns := []mapFunc{mapHisto, mapLinear, mapLog,
+		mapSqrt, mapMod, mapRank}
+	for _, f := range fns {
+		m.CMap = colorMap{Func: f, Contrast: 0.5}
+		p := -1.0
+		for i := 0; i < m.MaxIter; i++ {
+			v := m.norm(i)
+			if v < 0 || v > 1 {
+				t.Fatalf("func %d: norm(%d) = %f", f, i, v)
+			}
+			if f != mapMod && v < p {
+				t.Fatalf("func %d: norm(%d) = %f < %f",
+					f, i, v, p)
+			}
+			p = v
+		}
+	}
+	m.CMap = colorMap{Func: mapLinear}
+	if v := m.norm(m.MaxIter - 1); v != 1.0 {
+		t.Fatalf("linear: norm(MaxIter-1) = %f", v)
+	}
+	m.CMap = colorMap{Func: mapRank, Contrast: 1}
+	for i := 0; i < m.MaxIter; i++ {
+		if m.norm(i) != m.cnhisto[i] {
+			t.Fatalf("rank: norm(%d) != cnhisto[%d]", i, i)
+		}
+	}
+}
+
+func TestRefine(t *testing.T) {
+	m, err := newMandelImg(context.Background(), 160, 120, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 16, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.zs) != m.histo[m.MaxIter] {
+		t.Fatalf("len(zs) = %d != %d", len(m.zs), m.histo[m.MaxIter])
+	}
+	mr, err := m.refine(context.Background(), 64, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc, err := newMandelImg(context.Background(), 160, 120, pal256Gray,
+		complex(-2.0, -1.2), complex(1.0, 1.2), 64, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range mc.pix {
+		if mr.pix[i] != mc.pix[i] {
+			t.Fatalf("pix[%d] = %d != %d", i, mr.pix[i], mc.pix[i])
+		}
+	}
+	for i := range mc.histo {
+		if mr.histo[i] != mc.histo[i] {
+			t.Fatalf("histo[%d] = %d != %d",
+				i, mr.histo[i], mc.histo[i])
+		}
+	}
+	if len(mr.zs) != len(mc.zs) {
+		t.Fatalf("len(zs) = %d != %d", len(mr.zs), len(mc.zs))
+	}
+	if _, err := mr.refine(context.Background(), 32, nil); err == nil {
+		t.Fatal("refine to lower iteration count: no error")
+	}
+}
+
+// rowCtx is a context that is canceled after its first check (i.e.
+// during the first row of a calculation).
+type rowCtx struct {
+	context.Context
+	checks int
+}
+
+func (c *rowCtx) Err() error {
+	c.checks++
+	if c.checks > 1 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestMandelCancelRow(t *testing.T) {
+	// A single, wide row
+	const w = 4 * ctxPix
+	c0, c1 := complex(-2.0, 0.0), complex(1.0, 0.01)
+	for _, pass := range []passFunc{nil, func(*mandelImg, int) {}} {
+		ctx := &rowCtx{Context: context.Background()}
+		_, err := newMandelImg(ctx, w, 1, pal256Gray, c0, c1, 16, 2,
+			nil, pass)
+		if err != context.Canceled || ctx.checks != 2 {
+			t.Errorf("passes %v: %d checks, err %v",
+				pass != nil, ctx.checks, err)
+		}
+	}
+	m, err := newMandelImg(context.Background(), w, 1, pal256Gray,
+		c0, c1, 16, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &rowCtx{Context: context.Background()}
+	if _, err := m.refine(ctx, 32, nil); err != context.Canceled {
+		t.Errorf("refine: %d checks, err %v", ctx.checks, err)
+	}
+}
@@ -3,7 +3,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"image"
 	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // colPt specifies a "color point" in an interpolated gradient palette
@@ -126,21 +133,257 @@ var pal256Gray = grayPal(256, 0xff, false)
 // {0, 0, 0, 0xff}. All colors are of type color.RGBA
 var pal256GrayR = grayPal(256, 0xff, true)
 
-var pal256Gold1 = make(color.Palette, 256)
-var pal256Gold2 = make(color.Palette, 256)
-var pal256Blue1 = make(color.Palette, 256)
-var pal256Blue2 = make(color.Palette, 256)
-var pal256BRG = make(color.Palette, 256)
+// custPalSize is the number of slots in custom (user-specified)
+// gradient palettes.
+const custPalSize = 256
 
-func init() {
-	linGrad([]colPt{
+// fmtPalSpec formats the color points "pts" as a palette
+// specification string, suitable for passing in a URL query. The
+// specification is a comma-separated list of "idx:rrggbb" items,
+// where "idx" is the (decimal) palette index of the point and
+// "rrggbb" is its color in hex. Alpha is not encoded; all colors are
+// assumed fully opaque.
+func fmtPalSpec(pts []colPt) string {
+	s := make([]string, len(pts))
+	for i, p := range pts {
+		s[i] = fmt.Sprintf("%d:%02x%02x%02x",
+			p.Idx, p.Col.R, p.Col.G, p.Col.B)
+	}
+	return strings.Join(s, ",")
+}
+
+// parsePalSpec parses the palette specification string "s" (see
+// fmtPalSpec) and returns the color points it specifies. The points
+// must be given in strictly increasing index order, the first must
+// be at index 0 and the last at index size-1. At least 2, and no
+// more than "size", points must be given. Returns non-nil error if
+// the specification is invalid.
+func parsePalSpec(s string, size int) ([]colPt, error) {
+	items := strings.Split(s, ",")
+	if len(items) < 2 || len(items) > size {
+		return nil, errors.New("bad number of color points")
+	}
+	pts := make([]colPt, len(items))
+	for i, it := range items {
+		f := strings.SplitN(it, ":", 2)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("bad color point %q", it)
+		}
+		idx, err := strconv.Atoi(f[0])
+		if err != nil || idx < 0 || idx >= size {
+			return nil, fmt.Errorf("bad index in %q", it)
+		}
+		if i > 0 && idx <= pts[i-1].Idx {
+			return nil, fmt.Errorf("index out of order in %q", it)
+		}
+		if len(f[1]) != 6 {
+			return nil, fmt.Errorf("bad color in %q", it)
+		}
+		rgb, err := strconv.ParseUint(f[1], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad color in %q", it)
+		}
+		pts[i] = colPt{idx, color.RGBA{
+			uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 0xff}}
+	}
+	if pts[0].Idx != 0 || pts[len(pts)-1].Idx != size-1 {
+		return nil, errors.New("palette ends not specified")
+	}
+	return pts, nil
+}
+
+// linGrad2Pts returns the color points at which linGrad2 places the
+// colors "pts" when generating a palette of the given size. The
+// returned points can be used with linGrad (or fmtPalSpec) to
+// reproduce the palette generated by linGrad2.
+func linGrad2Pts(pts []color.RGBA, size int) []colPt {
+	n := len(pts)
+	if n < 2 || n > size {
+		return nil
+	}
+	cp := make([]colPt, n)
+	cp[0] = colPt{0, pts[0]}
+	for i := 1; i < n-1; i++ {
+		cp[i] = colPt{i * size / (n - 1), pts[i]}
+	}
+	cp[n-1] = colPt{size - 1, pts[n-1]}
+	return cp
+}
+
+// maxQuantSamples is the max number of pixels sampled from an image
+// for color quantization.
+const maxQuantSamples = 64 * 1024
+
+// sampleImg samples (at most maxQuantSamples) pixels from image
+// "img" and returns their colors. Pixels that are mostly transparent
+// are ignored.
+func sampleImg(img image.Image) []color.RGBA {
+	b := img.Bounds()
+	step := 1
+	for (b.Dx()/step)*(b.Dy()/step) > maxQuantSamples {
+		step++
+	}
+	var px []color.RGBA
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 0x80 {
+				continue
+			}
+			px = append(px, color.RGBA{c.R, c.G, c.B, 0xff})
+		}
+	}
+	return px
+}
+
+// rgbComp returns the i'th (0: red, 1: green, 2: blue) component of
+// color "c".
+func rgbComp(c color.RGBA, i int) uint8 {
+	switch i {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	default:
+		return c.B
+	}
+}
+
+// medianCut quantizes the colors "px" to (at most) "n" colors using
+// the median-cut algorithm: Starting with a single box containing
+// all the colors, it repeatedly splits the box with the largest
+// component range at the median of this component, until there are
+// "n" boxes, or no box can be split further. Returns the average
+// color of each box. The order of the colors in "px" is modified.
+func medianCut(px []color.RGBA, n int) []color.RGBA {
+	if len(px) == 0 {
+		return nil
+	}
+	boxes := [][]color.RGBA{px}
+	for len(boxes) < n {
+		// Find box (and component) with the largest range
+		bi, ci, rmax := -1, 0, 0
+		for i, b := range boxes {
+			for c := 0; c < 3; c++ {
+				lo, hi := 255, 0
+				for _, p := range b {
+					v := int(rgbComp(p, c))
+					if v < lo {
+						lo = v
+					}
+					if v > hi {
+						hi = v
+					}
+				}
+				if hi-lo > rmax {
+					bi, ci, rmax = i, c, hi-lo
+				}
+			}
+		}
+		if bi < 0 {
+			// All boxes contain a single color
+			break
+		}
+		b := boxes[bi]
+		sort.Slice(b, func(i, j int) bool {
+			return rgbComp(b[i], ci) < rgbComp(b[j], ci)
+		})
+		m := len(b) / 2
+		boxes[bi] = b[:m]
+		boxes = append(boxes, b[m:])
+	}
+	cols := make([]color.RGBA, len(boxes))
+	for i, b := range boxes {
+		var r, g, bl int
+		for _, p := range b {
+			r += int(p.R)
+			g += int(p.G)
+			bl += int(p.B)
+		}
+		n := len(b)
+		cols[i] = color.RGBA{
+			uint8(r / n), uint8(g / n), uint8(bl / n), 0xff}
+	}
+	return cols
+}
+
+// luma returns the luminance of color "c" (ITU-R BT.601)
+func luma(c color.RGBA) float64 {
+	return 0.299*float64(c.R) + 0.587*float64(c.G) +
+		0.114*float64(c.B)
+}
+
+// orderLum sorts the colors "cols" by increasing luminance.
+func orderLum(cols []color.RGBA) {
+	sort.SliceStable(cols, func(i, j int) bool {
+		return luma(cols[i]) < luma(cols[j])
+	})
+}
+
+// orderPath orders the colors "cols" along a path through the RGB
+// color space: Starting from the darkest color, every next color is
+// the one nearest (not already visited) to the previous.
+func orderPath(cols []color.RGBA) {
+	if len(cols) == 0 {
+		return
+	}
+	orderLum(cols)
+	dist := func(a, b color.RGBA) float64 {
+		dr := float64(a.R) - float64(b.R)
+		dg := float64(a.G) - float64(b.G)
+		db := float64(a.B) - float64(b.B)
+		return dr*dr + dg*dg + db*db
+	}
+	for i := 1; i < len(cols); i++ {
+		k, dmin := i, math.Inf(1)
+		for j := i; j < len(cols); j++ {
+			if d := dist(cols[i-1], cols[j]); d < dmin {
+				k, dmin = j, d
+			}
+		}
+		cols[i], cols[k] = cols[k], cols[i]
+	}
+}
+
+// imgPalPts extracts "n" representative colors from image "img"
+// (using median-cut quantization), orders them by luminance (if
+// "path" is false) or along a path through the color space (if
+// "path" is true) and returns the color points for generating a
+// gradient palette of the given size with the extracted colors (see
+// linGrad2 and linGrad2Pts). Returns non-nil error if less than 2
+// colors can be extracted from the image.
+func imgPalPts(img image.Image, n int, path bool,
+	size int) ([]colPt, error) {
+	cols := medianCut(sampleImg(img), n)
+	if len(cols) < 2 {
+		return nil, errors.New("too few colors in image")
+	}
+	if path {
+		orderPath(cols)
+	} else {
+		orderLum(cols)
+	}
+	return linGrad2Pts(cols, size), nil
+}
+
+// Color points for the predefined palettes. Used to generate the
+// palettes, and to initialize the palette editor.
+var (
+	pts256Gray = []colPt{
+		{0, color.RGBA{0x00, 0x00, 0x00, 0xff}},
+		{255, color.RGBA{0xff, 0xff, 0xff, 0xff}}}
+
+	pts256GrayR = []colPt{
+		{0, color.RGBA{0xff, 0xff, 0xff, 0xff}},
+		{255, color.RGBA{0x00, 0x00, 0x00, 0xff}}}
+
+	pts256Gold1 = []colPt{
 		{0, color.RGBA{0x00, 0x00, 0x00, 0xff}},
 		{220, color.RGBA{0x77, 0x55, 0x00, 0xff}},
 		{245, color.RGBA{0xff, 0xff, 0x00, 0xff}},
-		{255, color.RGBA{0xff, 0xff, 0xff, 0xff}}},
-		pal256Gold1)
+		{255, color.RGBA{0xff, 0xff, 0xff, 0xff}}}
 
-	linGrad([]colPt{
+	pts256Gold2 = []colPt{
 		{0, color.RGBA{0x00, 0x00, 0x00, 0xff}},
 		{75, color.RGBA{0x77, 0x22, 0x00, 0xff}},
 		{100, color.RGBA{0xff, 0xff, 0x00, 0xff}},
@@ -149,17 +392,15 @@ func init() {
 		{200, color.RGBA{0x00, 0x00, 0x00, 0xff}},
 		{225, color.RGBA{0x77, 0x22, 0x00, 0xff}},
 		{240, color.RGBA{0xff, 0xff, 0x00, 0xff}},
-		{255, color.RGBA{0xff, 0xff, 0xff, 0xff}}},
-		pal256Gold2)
+		{255, color.RGBA{0xff, 0xff, 0xff, 0xff}}}
 
-	linGrad([]colPt{
+	pts256Blue1 = []colPt{
 		{0, color.RGBA{0x00, 0x00, 0x00, 0xff}},
 		{220, color.RGBA{0x00, 0x00, 0x55, 0xff}},
 		{245, color.RGBA{0x44, 0x44, 0xff, 0xff}},
-		{255, color.RGBA{0xff, 0xff, 0xff, 0xff}}},
-		pal256Blue1)
+		{255, color.RGBA{0xff, 0xff, 0xff, 0xff}}}
 
-	linGrad([]colPt{
+	pts256Blue2 = []colPt{
 		{0, color.RGBA{0x00, 0x00, 0x00, 0xff}},
 		{50, color.RGBA{0x22, 0x22, 0x55, 0xff}},
 		{100, color.RGBA{0x10, 0x10, 0x55, 0xff}},
@@ -168,6 +409,18 @@ func init() {
 		{200, color.RGBA{0x22, 0x22, 0x77, 0xff}},
 		{225, color.RGBA{0x00, 0x00, 0x20, 0xff}},
 		{240, color.RGBA{0x22, 0x22, 0x77, 0xff}},
-		{255, color.RGBA{0xff, 0xff, 0xff, 0xff}}},
-		pal256Blue2)
+		{255, color.RGBA{0xff, 0xff, 0xff, 0xff}}}
+)
+
+var pal256Gold1 = make(color.Palette, 256)
+var pal256Gold2 = make(color.Palette, 256)
+var pal256Blue1 = make(color.Palette, 256)
+var pal256Blue2 = make(color.Palette, 256)
+var pal256BRG = make(color.Palette, 256)
+
+func init() {
+	linGrad(pts256Gold1, pal256Gold1)
+	linGrad(pts256Gold2, pal256Gold2)
+	linGrad(pts256Blue1, pal256Blue1)
+	linGrad(pts256Blue2, pal256Blue2)
 }
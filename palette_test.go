@@ -1,6 +1,7 @@
 package main
 
 import (
+	"image"
 	"image/color"
 	"testing"
 )
@@ -154,3 +155,91 @@ func TestGrayPal(t *testing.T) {
 	}
 
 }
+
+func TestPalSpec(t *testing.T) {
+	s := fmtPalSpec(pts256Gold1)
+	if s != "0:000000,220:775500,245:ffff00,255:ffffff" {
+		t.Fatalf("fmtPalSpec: %s", s)
+	}
+	pts, err := parsePalSpec(s, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pts) != len(pts256Gold1) {
+		t.Fatalf("len(pts) = %d", len(pts))
+	}
+	for i := range pts {
+		if pts[i] != pts256Gold1[i] {
+			t.Fatalf("%d:%v", i, pts[i])
+		}
+	}
+	bad := []string{
+		"",
+		"0:000000",
+		"0:000000,255",
+		"0:000000,256:ffffff",
+		"1:000000,255:ffffff",
+		"0:000000,254:ffffff",
+		"0:000000,100:ff0000,100:00ff00,255:ffffff",
+		"0:000000,200:ff0000,100:00ff00,255:ffffff",
+		"0:00000,255:ffffff",
+		"0:00000g,255:ffffff",
+		"x:000000,255:ffffff"}
+	for _, s := range bad {
+		if _, err := parsePalSpec(s, 256); err == nil {
+			t.Fatalf("parsePalSpec(%q): no error", s)
+		}
+	}
+}
+
+func TestLinGrad2Pts(t *testing.T) {
+	cols := []color.RGBA{
+		{0, 0, 0, 0xff},
+		{0xff, 0, 0, 0xff},
+		{0, 0xff, 0, 0xff},
+		{0xff, 0xff, 0xff, 0xff}}
+	p2 := linGrad2(cols, 256)
+	p := make(color.Palette, 256)
+	linGrad(linGrad2Pts(cols, 256), p)
+	for i := range p {
+		if p[i] != p2[i] {
+			t.Fatalf("%d: %v != %v", i, p[i], p2[i])
+		}
+	}
+}
+
+func TestMedianCut(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 10))
+	cols := []color.RGBA{
+		{0xff, 0xff, 0xff, 0xff},
+		{0x10, 0x10, 0x10, 0xff},
+		{0xff, 0x00, 0x00, 0xff},
+		{0x00, 0x00, 0xff, 0xff}}
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 10; y++ {
+			img.Set(x, y, cols[x/10])
+		}
+	}
+	q := medianCut(sampleImg(img), 8)
+	if len(q) != 4 {
+		t.Fatalf("len(q) = %d", len(q))
+	}
+	orderLum(q)
+	want := []color.RGBA{cols[1], cols[3], cols[2], cols[0]}
+	for i := range q {
+		if q[i] != want[i] {
+			t.Fatalf("%d: %v != %v", i, q[i], want[i])
+		}
+	}
+	pts, err := imgPalPts(img, 2, true, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pts) != 2 || pts[0].Idx != 0 || pts[1].Idx != 255 {
+		t.Fatalf("pts = %v", pts)
+	}
+	img = image.NewRGBA(image.Rect(0, 0, 10, 10))
+	if _, err := imgPalPts(img, 8, false, 256); err == nil {
+		t.Fatal("imgPalPts: no error for single-color image")
+	}
+}
@@ -0,0 +1,239 @@
+// Cache shared between multiple instances (peers) of the program
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Number of points on the hash ring, per peer
+	peerVNodes = 128
+	// Path of the endpoint peers fetch images from
+	peerPath = "/peer/img"
+)
+
+// peerRing assigns images to peers using consistent hashing: Every
+// peer is placed on a ring (the space of 64-bit hash values) at
+// several points, and every image belongs to the peer at the first
+// point following the hash of the image's key. Adding or removing a
+// peer reassigns only the images that belong to (or are taken over
+// by) that peer. Peers are identified by their base URLs. All peers
+// must be configured with the same list of URLs.
+type peerRing struct {
+	// Base URL of this instance
+	self string
+	// Points on the ring, sorted by hash
+	points []ringPoint
+	// Client used to fetch images from peers
+	client *http.Client
+}
+
+// ringPoint is a point on the hash ring.
+type ringPoint struct {
+	hash uint64
+	peer string
+}
+
+// newPeerRing creates a ring with peers "peers" (base URLs), where
+// "self" is the URL of this instance. Images are fetched from peers
+// with the given timeout. Returns non-nil error if "self" is not one
+// of the peers.
+func newPeerRing(self string, peers []string,
+	timeout time.Duration) (*peerRing, error) {
+	pr := &peerRing{
+		self:   strings.TrimSuffix(self, "/"),
+		client: &http.Client{Timeout: timeout},
+	}
+	found := false
+	for _, p := range peers {
+		p = strings.TrimSuffix(p, "/")
+		if p == "" {
+			continue
+		}
+		if p == pr.self {
+			found = true
+		}
+		for i := 0; i < peerVNodes; i++ {
+			s := fmt.Sprintf("%s#%d", p, i)
+			h := sha256.Sum256([]byte(s))
+			pr.points = append(pr.points, ringPoint{
+				hash: binary.BigEndian.Uint64(h[:8]),
+				peer: p,
+			})
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("peers: Self (%s) not in peer list",
+			self)
+	}
+	sort.Slice(pr.points, func(i, j int) bool {
+		return pr.points[i].hash < pr.points[j].hash
+	})
+	return pr, nil
+}
+
+// owner returns the base URL of the peer the image with key "k"
+// belongs to.
+func (pr *peerRing) owner(k cacheKey) string {
+	h := k.hash()
+	kh := binary.BigEndian.Uint64(h[:8])
+	i := sort.Search(len(pr.points), func(i int) bool {
+		return pr.points[i].hash >= kh
+	})
+	if i == len(pr.points) {
+		i = 0
+	}
+	return pr.points[i].peer
+}
+
+// fetch asks the peer that owns the image with key "k" for it (the
+// peer renders the image, if it does not have it already). Returns
+// nil and no error if the image belongs to this instance, in which
+// case it should be calculated locally. Returns non-nil error if the
+// image cannot be fetched from its owner, or if ctx is done before it
+// is fetched.
+func (pr *peerRing) fetch(ctx context.Context,
+	k cacheKey) (*mandelImg, error) {
+	peer := pr.owner(k)
+	if peer == pr.self {
+		return nil, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		peer+peerPath+"?"+keyQuery(k), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := pr.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peers: %s: %s", peer, resp.Status)
+	}
+	m, err := readImg(bufio.NewReader(resp.Body))
+	if err != nil {
+		return nil, err
+	}
+	if imgKey(m) != k {
+		return nil, errors.New("peers: Peer returned wrong image")
+	}
+	return m, nil
+}
+
+// keyQuery returns the URL query string that identifies key "k" in
+// requests to peers. Coordinates are formatted so that they are
+// parsed back to the exact same values.
+func keyQuery(k cacheKey) string {
+	f := func(x float64) string {
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	v := url.Values{}
+	v.Set("sx", strconv.Itoa(k.Sx))
+	v.Set("sy", strconv.Itoa(k.Sy))
+	v.Set("iter", strconv.Itoa(k.Iter))
+	v.Set("x0", f(k.X0))
+	v.Set("y0", f(k.Y0))
+	v.Set("x1", f(k.X1))
+	v.Set("y1", f(k.Y1))
+	return v.Encode()
+}
+
+// parseKeyQuery parses a query string produced by keyQuery. Unlike
+// getParams, it does not clamp values to their allowed ranges (so
+// that the key is reproduced exactly), but returns non-nil error if a
+// value is invalid.
+func parseKeyQuery(v url.Values) (cacheKey, error) {
+	var k cacheKey
+	ints := []struct {
+		name string
+		max  int
+		val  *int
+	}{
+		{"sx", maxSx, &k.Sx}, {"sy", maxSy, &k.Sy},
+		{"iter", maxIter, &k.Iter},
+	}
+	for _, i := range ints {
+		n, err := strconv.Atoi(v.Get(i.name))
+		if err != nil || n <= 0 || n > i.max {
+			return k, fmt.Errorf("peers: Bad %s", i.name)
+		}
+		*i.val = n
+	}
+	floats := []struct {
+		name string
+		val  *float64
+	}{
+		{"x0", &k.X0}, {"y0", &k.Y0}, {"x1", &k.X1}, {"y1", &k.Y1},
+	}
+	for _, f := range floats {
+		x, err := strconv.ParseFloat(v.Get(f.name), 64)
+		if err != nil || math.IsNaN(x) || math.IsInf(x, 0) {
+			return k, fmt.Errorf("peers: Bad %s", f.name)
+		}
+		*f.val = x
+	}
+	if k.X0 >= k.X1 || k.Y0 >= k.Y1 {
+		return k, errors.New("peers: Bad domain")
+	}
+	return k, nil
+}
+
+// peerHandler serves images to peers. The image is looked-up in the
+// local caches or calculated locally (never forwarded to another
+// peer), and sent in the disk-cache file format. The calculation is
+// canceled if the requesting peer goes away. Renders are subject to
+// admission control, like those for clients (see admitRender), since
+// the endpoint is reachable by anyone; peers whose requests are
+// rejected calculate the image themselves.
+func peerHandler(w http.ResponseWriter, r *http.Request) {
+	k, err := parseKeyQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := &params{
+		Sx: k.Sx, Sy: k.Sy, Iter: k.Iter,
+		X0: k.X0, Y0: k.Y0, X1: k.X1, Y1: k.Y1,
+		Pal: dflPal, Palettes: palettes,
+	}
+	release, err := admitRender(r, p)
+	if err != nil {
+		http.Error(w, err.Error(), admitStatus(w, err))
+		return
+	}
+	defer release()
+	ctx, cancel := renderContext(r.Context())
+	defer cancel()
+	img, err := imgCache.ReqLookup(ctx, p)
+	if err != nil {
+		return
+	}
+	if img == nil {
+		img, err = calcLocal(ctx, p, false, nil, nil)
+		if err != nil {
+			http.Error(w, err.Error(), renderStatus(err))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	bw := bufio.NewWriter(w)
+	if err := img.writeTo(bw); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	bw.Flush()
+}
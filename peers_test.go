@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPeerRing(t *testing.T) {
+	peers := []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+	pr3, err := newPeerRing(peers[0], peers, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr2, err := newPeerRing(peers[0], peers[:2], time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newPeerRing("http://d:8080", peers, time.Second); err == nil {
+		t.Fatal("self not in peers: no error")
+	}
+	const nkeys = 3000
+	owned := map[string]int{}
+	for i := 0; i < nkeys; i++ {
+		k := cacheKey{Sx: 640, Sy: 512, Iter: 64 + i,
+			X0: -2, Y0: -1.2, X1: 1, Y1: 1.2}
+		o3, o2 := pr3.owner(k), pr2.owner(k)
+		owned[o3]++
+		// Removing a peer must only move the keys it owned
+		if o3 != peers[2] && o2 != o3 {
+			t.Fatalf("key %d moved from %s to %s", i, o3, o2)
+		}
+	}
+	for _, p := range peers {
+		if owned[p] < nkeys/5 || owned[p] > nkeys/2 {
+			t.Errorf("%s owns %d of %d keys", p, owned[p], nkeys)
+		}
+	}
+}
+
+func TestKeyQuery(t *testing.T) {
+	k := cacheKey{Sx: 640, Sy: 512, Iter: 1000,
+		X0: -0.7436438870371587, Y0: 0.1318259042053119,
+		X1: -0.7436438870371586, Y1: 1.0 / 3}
+	v, err := url.ParseQuery(keyQuery(k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k1, err := parseKeyQuery(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 != k {
+		t.Fatalf("key %+v != %+v", k1, k)
+	}
+	v.Set("x1", v.Get("x0"))
+	if _, err := parseKeyQuery(v); err == nil {
+		t.Fatal("empty domain: no error")
+	}
+}
+
+func TestPeerFetch(t *testing.T) {
+	saved := imgCache
+	defer func() { imgCache = saved }()
+	imgCache = newCache(1 << 30)
+	srv := httptest.NewServer(http.HandlerFunc(peerHandler))
+	defer srv.Close()
+	self := "http://localhost:1"
+	pr, err := newPeerRing(self, []string{self, srv.URL}, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Find a key owned by each peer
+	var kr, kl cacheKey
+	for i := 16; kr.Sx == 0 || kl.Sx == 0; i++ {
+		k := cacheKey{Sx: 160, Sy: 120, Iter: i,
+			X0: -2, Y0: -1.2, X1: 1, Y1: 1.2}
+		if pr.owner(k) == self {
+			kl = k
+		} else {
+			kr = k
+		}
+	}
+	if m, err := pr.fetch(context.Background(), kl); m != nil || err != nil {
+		t.Fatalf("local key: %v, %v", m, err)
+	}
+	m, err := pr.fetch(context.Background(), kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imgKey(m) != kr {
+		t.Fatalf("fetched %+v, want %+v", imgKey(m), kr)
+	}
+	mc, err := newMandelImg(context.Background(), kr.Sx, kr.Sy, pal256Gray,
+		complex(kr.X0, kr.Y0), complex(kr.X1, kr.Y1), kr.Iter, 100.0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range mc.pix {
+		if m.pix[i] != mc.pix[i] {
+			t.Fatalf("pixel %d: %d != %d", i, m.pix[i], mc.pix[i])
+		}
+	}
+	// The owner must have cached the image
+	st := imgCache.ReqStats()
+	if len(st.Entries) != 1 {
+		t.Fatalf("owner cache entries: %d", len(st.Entries))
+	}
+}
+
+func TestPeerAdmission(t *testing.T) {
+	saved, savedAdm := imgCache, admission
+	defer func() { imgCache, admission = saved, savedAdm }()
+	imgCache = newCache(1 << 30)
+	admission = newAdmitter(admitLimits{MaxCost: 100})
+	k := cacheKey{Sx: 10240, Sy: 8192, Iter: maxIter,
+		X0: -2, Y0: -1.2, X1: 1, Y1: 1.2}
+	r := httptest.NewRequest("GET", peerPath+"?"+keyQuery(k), nil)
+	w := httptest.NewRecorder()
+	peerHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d", w.Code)
+	}
+	if st := imgCache.ReqStats(); st.Flights != 0 {
+		t.Fatalf("flights %d", st.Flights)
+	}
+}
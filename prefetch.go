@@ -0,0 +1,157 @@
+// Prefetch (render in the background) views adjacent to the ones
+// requested
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// prefetchPoll is the interval at which the prefetcher checks if
+// there are images being calculated for clients, before starting a
+// prefetch.
+const prefetchPoll = 100 * time.Millisecond
+
+// prefetcher renders, in the background, the views that are likely
+// to be requested after a given view. Only the neighbors of the most
+// recent view are prefetched. Prefetching yields to images being
+// calculated for clients: It never starts while such images are being
+// calculated, and a prefetch in progress is canceled (and retried
+// later) when the calculation of such an image starts.
+type prefetcher struct {
+	mu sync.Mutex
+	// Most recent view, not yet processed
+	next *params
+	// Cancels the prefetch in progress (nil if none)
+	cancel context.CancelFunc
+	// Signals that next was set
+	notify chan struct{}
+}
+
+// newPrefetcher creates a prefetcher and starts the goroutine that
+// does the prefetching. Returns a pointer to the prefetcher.
+func newPrefetcher() *prefetcher {
+	pf := &prefetcher{notify: make(chan struct{}, 1)}
+	go pf.run()
+	return pf
+}
+
+// ReqView notifies the prefetcher that the view with parameters "p"
+// was requested. Prefetching of the neighbors of a previous view is
+// abandoned.
+func (pf *prefetcher) ReqView(p *params) {
+	pf.mu.Lock()
+	pf.next = p
+	pf.mu.Unlock()
+	select {
+	case pf.notify <- struct{}{}:
+	default:
+	}
+}
+
+// preempt cancels the prefetch in progress, if any.
+func (pf *prefetcher) preempt() {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.cancel != nil {
+		pf.cancel()
+	}
+}
+
+// take returns the most recent view not yet processed (or nil)
+func (pf *prefetcher) take() *params {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	p := pf.next
+	pf.next = nil
+	return p
+}
+
+func (pf *prefetcher) run() {
+	var pending []*params
+	for {
+		if len(pending) == 0 {
+			<-pf.notify
+		}
+		if p := pf.take(); p != nil {
+			pending = neighbors(p)
+			continue
+		}
+		if atomic.LoadInt32(&activeRenders) > 0 {
+			select {
+			case <-pf.notify:
+			case <-time.After(prefetchPoll):
+			}
+			continue
+		}
+		if pf.fetch(pending[0]) {
+			pending = pending[1:]
+		}
+	}
+}
+
+// fetch renders the image with parameters "p" and adds it to the
+// cache, unless it is already cached (or being rendered). Returns
+// false if the prefetch was preempted (see preempt).
+func (pf *prefetcher) fetch(p *params) bool {
+	if !imgCache.ReqClaim(p) {
+		return true
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pf.mu.Lock()
+	pf.cancel = cancel
+	pf.mu.Unlock()
+	// A calculation for a client may have started before the
+	// prefetch could be preempted
+	if atomic.LoadInt32(&activeRenders) > 0 {
+		cancel()
+	}
+	_, err := calcImg(ctx, p, true, nil, nil)
+	pf.mu.Lock()
+	pf.cancel = nil
+	pf.mu.Unlock()
+	cancel()
+	return !errors.Is(err, context.Canceled)
+}
+
+// inDomain returns true if the domain of view "p" is within the
+// limits of the function domain.
+func inDomain(p *params) bool {
+	return p.X0 >= minX && p.X0 <= maxX &&
+		p.X1 >= minX && p.X1 <= maxX &&
+		p.Y0 >= minY && p.Y0 <= maxY &&
+		p.Y1 >= minY && p.Y1 <= maxY
+}
+
+// neighbors returns the views that are likely to be requested after
+// view "p", most likely first: Zoom-in (2x) to the center, zoom-out
+// (2x), and pan in the four directions. Views outside the limits of
+// the function domain are omitted.
+func neighbors(p *params) []*params {
+	dx, dy := p.X1-p.X0, p.Y1-p.Y0
+	cx, cy := p.X0+dx/2, p.Y0+dy/2
+	doms := [][4]float64{
+		// Zoom-in to center
+		{cx - dx/4, cy - dy/4, cx + dx/4, cy + dy/4},
+		// Zoom-out
+		{cx - dx, cy - dy, cx + dx, cy + dy},
+		// Pan
+		{p.X0 + dx, p.Y0, p.X1 + dx, p.Y1},
+		{p.X0 - dx, p.Y0, p.X1 - dx, p.Y1},
+		{p.X0, p.Y0 + dy, p.X1, p.Y1 + dy},
+		{p.X0, p.Y0 - dy, p.X1, p.Y1 - dy},
+	}
+	var ns []*params
+	for _, d := range doms {
+		np := *p
+		np.X0, np.Y0, np.X1, np.Y1 = d[0], d[1], d[2], d[3]
+		if inDomain(&np) {
+			ns = append(ns, &np)
+		}
+	}
+	return ns
+}
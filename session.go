@@ -0,0 +1,142 @@
+// Per-session (user-registered) palettes
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"image/color"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Name of the session cookie
+	sessCookie = "mandel-sid"
+	// Max number of sessions to keep
+	maxSessions = 1024
+	// Max number of palettes per session
+	maxSessPals = 16
+)
+
+// session keeps the palettes registered by a user
+type session struct {
+	// Palettes and their color points, keyed by name
+	pals map[string]color.Palette
+	pts  map[string][]colPt
+	// Last time the session was used
+	used time.Time
+}
+
+// sessStore keeps the user sessions. It is safe for concurrent use.
+type sessStore struct {
+	mu sync.Mutex
+	m  map[string]*session
+}
+
+var sessions = &sessStore{m: make(map[string]*session)}
+
+// get returns the session for request "r", or nil if the request
+// does not belong to a (known) session. Must be called with s.mu
+// held.
+func (s *sessStore) get(r *http.Request) *session {
+	ck, err := r.Cookie(sessCookie)
+	if err != nil {
+		return nil
+	}
+	ss := s.m[ck.Value]
+	if ss != nil {
+		ss.used = time.Now()
+	}
+	return ss
+}
+
+// create creates a new session, and sets the session cookie in the
+// response "w". If there are too many sessions, the least recently
+// used one is dropped. Must be called with s.mu held.
+func (s *sessStore) create(w http.ResponseWriter) (*session, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(b)
+	if len(s.m) >= maxSessions {
+		var oid string
+		var ot time.Time
+		for k, v := range s.m {
+			if oid == "" || v.used.Before(ot) {
+				oid, ot = k, v.used
+			}
+		}
+		delete(s.m, oid)
+	}
+	ss := &session{
+		pals: make(map[string]color.Palette),
+		pts:  make(map[string][]colPt),
+		used: time.Now(),
+	}
+	s.m[id] = ss
+	http.SetCookie(w, &http.Cookie{
+		Name: sessCookie, Value: id, Path: "/", HttpOnly: true})
+	return ss, nil
+}
+
+// palettes returns the palettes (and their color points) available to
+// the request "r": The predefined palettes, plus the palettes
+// registered in the request's session. The returned maps must not be
+// modified.
+func (s *sessStore) palettes(r *http.Request) (
+	map[string]color.Palette, map[string][]colPt) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss := s.get(r)
+	if ss == nil || len(ss.pals) == 0 {
+		return palettes, palStops
+	}
+	pals := make(map[string]color.Palette, len(palettes)+len(ss.pals))
+	pts := make(map[string][]colPt, len(palStops)+len(ss.pts))
+	for n, p := range palettes {
+		pals[n] = p
+	}
+	for n, p := range palStops {
+		pts[n] = p
+	}
+	for n, p := range ss.pals {
+		pals[n] = p
+		pts[n] = ss.pts[n]
+	}
+	return pals, pts
+}
+
+// addPalette registers a palette, generated from the color points
+// "pts", with the given name, in the session of request "r". If the
+// request does not belong to a session, a new session is created
+// (and the session cookie is set in "w"). Returns non-nil error if
+// the name is already used by a predefined palette, or if the session
+// has too many palettes.
+func (s *sessStore) addPalette(w http.ResponseWriter, r *http.Request,
+	name string, pts []colPt, size int) error {
+	if _, ok := palettes[name]; ok {
+		return errors.New("palette name in use")
+	}
+	pal := make(color.Palette, size)
+	linGrad(pts, pal)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss := s.get(r)
+	if ss == nil {
+		var err error
+		ss, err = s.create(w)
+		if err != nil {
+			return err
+		}
+	}
+	if _, ok := ss.pals[name]; !ok && len(ss.pals) >= maxSessPals {
+		return errors.New("too many palettes")
+	}
+	ss.pals[name] = pal
+	ss.pts[name] = pts
+	return nil
+}
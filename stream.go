@@ -0,0 +1,111 @@
+// Progressive rendering, streamed to the browser as Server-Sent Events
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"net/http"
+)
+
+// sendEvent sends a Server-Sent Event with the given name, and data
+// "v" encoded as JSON, and flushes it to the client.
+func sendEvent(w http.ResponseWriter, name string, v interface{}) {
+	b, _ := json.Marshal(v)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, b)
+	w.(http.Flusher).Flush()
+}
+
+// passEvent is a pass of a progressive calculation (see passFunc).
+type passEvent struct {
+	m      *mandelImg
+	stride int
+}
+
+// passQueue hands the passes of a calculation over to the goroutine
+// that streams them, without blocking the calculation (which other
+// requests may be waiting for): It holds the latest pass only. A pass
+// not yet taken when the next one is put is dropped. There must be a
+// single goroutine putting passes (the calculation).
+type passQueue chan passEvent
+
+func newPassQueue() passQueue { return make(passQueue, 1) }
+
+// put puts a pass in the queue, dropping the previous one, if not
+// taken. It never blocks.
+func (q passQueue) put(m *mandelImg, stride int) {
+	select {
+	case <-q:
+	default:
+	}
+	q <- passEvent{m, stride}
+}
+
+// streamHandler renders the image with the given parameters
+// progressively, streaming the coarse passes (see calcPasses) to the
+// client as Server-Sent Events. A "pass" event is sent after each
+// pass, with the pass's stride and the image calculated so far (as a
+// PNG data URL). Passes are encoded and sent outside the calculation,
+// and are skipped if the client cannot keep up. When the image is
+// ready (it is then cached) a "done" event is sent, with the image's
+// URL. If the image cannot be rendered a "fail" event is sent, with
+// the error message. Images found in the cache, or being rendered for
+// other requests, are not streamed: Only the "done" event is sent
+// when they are ready. The render is admitted (see admitRender) for
+// the stream, and released before the "done" event, so clients
+// should request the image when they receive it.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	p := getParams(r)
+	if p.Strict && p.Errors != nil {
+		paramsError(w, r, p.Errors)
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming not supported",
+			http.StatusInternalServerError)
+		return
+	}
+	release, err := admitRender(r, p)
+	if err != nil {
+		http.Error(w, err.Error(), admitStatus(w, err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ctx, cancel := renderContext(r.Context())
+	defer cancel()
+	passes := newPassQueue()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := lookupImg(ctx, p, nil, passes.put)
+		done <- err
+	}()
+	pal, cm := p.palette(), p.colorMap()
+loop:
+	for {
+		select {
+		case pe := <-passes:
+			var buf bytes.Buffer
+			png.Encode(&buf, pe.m.Repalette(pal).Remap(cm))
+			sendEvent(w, "pass", map[string]interface{}{
+				"stride": pe.stride,
+				"image": "data:image/png;base64," +
+					base64.StdEncoding.EncodeToString(
+						buf.Bytes()),
+			})
+		case err = <-done:
+			break loop
+		}
+	}
+	release()
+	if err != nil {
+		sendEvent(w, "fail", map[string]string{"error": err.Error()})
+		return
+	}
+	sendEvent(w, "done", map[string]string{
+		"url": "/mandel?" + string(p.URL()),
+	})
+}
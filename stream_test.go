@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	saved := imgCache
+	defer func() { imgCache = saved }()
+	imgCache = newCache(1 << 30)
+	url := "/mandel/stream?sx=320&sy=256&iter=64"
+	// The second time the image is cached: No passes
+	for i, maxPasses := range []int{3, 0} {
+		w := httptest.NewRecorder()
+		streamHandler(w, httptest.NewRequest("GET", url, nil))
+		if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("%d: content type %q", i, ct)
+		}
+		var events []string
+		for _, l := range strings.Split(w.Body.String(), "\n") {
+			if strings.HasPrefix(l, "event: ") {
+				events = append(events, l[len("event: "):])
+			}
+		}
+		// Passes may be skipped, if the stream does not keep up
+		got := strings.Join(events, " ")
+		n := strings.Count(got, "pass ")
+		if strings.Replace(got, "pass ", "", -1) != "done" ||
+			n > maxPasses {
+			t.Fatalf("%d: events %q", i, got)
+		}
+	}
+}
+
+func TestPassQueue(t *testing.T) {
+	q := newPassQueue()
+	// Never blocks; keeps the latest pass
+	for _, s := range []int{8, 4, 2} {
+		q.put(nil, s)
+	}
+	if pe := <-q; pe.stride != 2 {
+		t.Fatalf("stride %d", pe.stride)
+	}
+	select {
+	case pe := <-q:
+		t.Fatalf("stride %d left in queue", pe.stride)
+	default:
+	}
+}
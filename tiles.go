@@ -0,0 +1,178 @@
+// Slippy-map (XYZ) tiles, and the map viewer
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Tile size (in pixels; tiles are square)
+	tileSize = 256
+	// Max zoom level. Deeper zooms exceed the precision of float64
+	// coordinates
+	maxTileZoom = 40
+	// Domain of the single tile of zoom level 0: A square, with
+	// its top-left corner at (tileX0, tileY0), covering the whole
+	// set. At every zoom level each tile is split in four
+	tileX0   = -2.25
+	tileY0   = -1.5
+	tileSpan = 3.0
+	// Iteration count of the tiles of zoom level z (if not given
+	// with the "iter" parameter): tileIter + z * tileIterZ
+	tileIter  = 64
+	tileIterZ = 48
+	// Default mapping function for tiles. Histogram and rank
+	// coloring depend on the contents of each tile, which shows
+	// as seams between tiles
+	dflTileMap = "Log"
+)
+
+// tileIterCount returns the (auto-scaled) iteration count for tiles
+// of zoom level z.
+func tileIterCount(z int) int {
+	iter := tileIter + z*tileIterZ
+	if iter > maxIter {
+		iter = maxIter
+	}
+	return iter
+}
+
+// parseTilePath parses the tile path "<z>/<x>/<y>.png" (relative to
+// /tiles/). Returns the tile's zoom level and coordinates, and false
+// if the path is invalid or the tile does not exist.
+func parseTilePath(path string) (z, x, y int, ok bool) {
+	if !strings.HasSuffix(path, ".png") {
+		return 0, 0, 0, false
+	}
+	f := strings.Split(strings.TrimSuffix(path, ".png"), "/")
+	if len(f) != 3 {
+		return 0, 0, 0, false
+	}
+	var v [3]int
+	for i := range f {
+		n, err := strconv.Atoi(f[i])
+		if err != nil || n < 0 {
+			return 0, 0, 0, false
+		}
+		v[i] = n
+	}
+	z, x, y = v[0], v[1], v[2]
+	if z > maxTileZoom || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return 0, 0, 0, false
+	}
+	return z, x, y, true
+}
+
+// tileParams returns the parameters of tile (z, x, y). The palette
+// and color-map parameters are taken from request "r" (see
+// getParams), as is the iteration count, if given. Otherwise the
+// iteration count is scaled with the zoom level (see tileIterCount).
+// Size and domain parameters in "r" are ignored.
+func tileParams(r *http.Request, z, x, y int) *params {
+	p := getParams(r)
+	// Drop errors for the parameters replaced below
+	var fe fieldErrors
+	for _, e := range p.Errors {
+		switch e.Field {
+		case "sx", "sy", "x0", "y0", "x1", "y1":
+		default:
+			fe = append(fe, e)
+		}
+	}
+	p.Errors = fe
+	p.Sx, p.Sy = tileSize, tileSize
+	if r.FormValue("iter") == "" {
+		p.Iter = tileIterCount(z)
+	}
+	if r.FormValue("map") == "" {
+		p.Map = dflTileMap
+	}
+	span := tileSpan / float64(uint64(1)<<uint(z))
+	p.X0 = tileX0 + float64(x)*span
+	p.Y0 = tileY0 + float64(y)*span
+	p.X1 = p.X0 + span
+	p.Y1 = p.Y0 + span
+	return p
+}
+
+// tileHandler serves tiles, at /tiles/<z>/<x>/<y>.png. Tiles are
+// served like images (see serveImg). Palette, color-map, and
+// iteration-count parameters are accepted as for /mandel.
+func tileHandler(w http.ResponseWriter, r *http.Request) {
+	z, x, y, ok := parseTilePath(strings.TrimPrefix(r.URL.Path,
+		"/tiles/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	p := tileParams(r, z, x, y)
+	if p.Strict && p.Errors != nil {
+		paramsError(w, r, p.Errors)
+		return
+	}
+	serveImg(w, r, p, false, false)
+}
+
+// mapPage is the data for the map viewer template.
+type mapPage struct {
+	*params
+	// Tile URL query string: The palette and color-map
+	// parameters, and the iteration count, if fixed
+	TileQuery template.URL
+	// Iteration count is fixed (given), not scaled with zoom
+	FixedIter bool
+	// Tile pyramid (see the tile* constants)
+	TileSize, MaxZoom   int
+	TileIter, TileIterZ int
+	TileX0, TileY0      float64
+	TileSpan            float64
+	// Max iteration count
+	IterLimit int
+}
+
+// MapURL returns the URL query string for the map viewer, showing
+// the image's domain with its palette and color map (see mapHandler).
+// The iteration count is not included: The map scales it with the
+// zoom level.
+func (p *params) MapURL() template.URL {
+	s := fmt.Sprintf("sx=%d&sy=%d&x0=%g&y0=%g&x1=%g&y1=%g&",
+		p.Sx, p.Sy, p.X0, p.Y0, p.X1, p.Y1)
+	return template.URL(s + p.palQuery())
+}
+
+// mapHandler serves the map viewer. The viewer initially shows the
+// domain given by the x0, y0, x1, y1 parameters (see getParams), and
+// renders the tiles with the palette, color-map, and iteration-count
+// parameters given (see tileHandler).
+func mapHandler(w http.ResponseWriter, r *http.Request) {
+	p := getParams(r)
+	if r.FormValue("map") == "" {
+		p.Map = dflTileMap
+	}
+	mp := &mapPage{
+		params:    p,
+		FixedIter: r.FormValue("iter") != "",
+		TileSize:  tileSize,
+		MaxZoom:   maxTileZoom,
+		TileIter:  tileIter,
+		TileIterZ: tileIterZ,
+		TileX0:    tileX0,
+		TileY0:    tileY0,
+		TileSpan:  tileSpan,
+		IterLimit: maxIter,
+	}
+	q := p.palQuery()
+	if mp.FixedIter {
+		q += "&iter=" + strconv.Itoa(p.Iter)
+	}
+	mp.TileQuery = template.URL(q)
+	if p.Strict && p.Errors != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	renderTmpl(w, "map", mp)
+}
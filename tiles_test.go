@@ -0,0 +1,85 @@
+package main
+
+import (
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTilePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		z, x, y int
+		ok      bool
+	}{
+		{"0/0/0.png", 0, 0, 0, true},
+		{"3/7/5.png", 3, 7, 5, true},
+		{"40/1099511627775/0.png", 40, 1<<40 - 1, 0, true},
+		{"3/8/0.png", 0, 0, 0, false},
+		{"41/0/0.png", 0, 0, 0, false},
+		{"1/-1/0.png", 0, 0, 0, false},
+		{"1/0/0", 0, 0, 0, false},
+		{"1/0/0.jpg", 0, 0, 0, false},
+		{"1/0.png", 0, 0, 0, false},
+		{"1/a/0.png", 0, 0, 0, false},
+	}
+	for _, tc := range tests {
+		z, x, y, ok := parseTilePath(tc.path)
+		if ok != tc.ok || z != tc.z || x != tc.x || y != tc.y {
+			t.Errorf("%s: %d/%d/%d %v", tc.path, z, x, y, ok)
+		}
+	}
+}
+
+func TestTileParams(t *testing.T) {
+	r := httptest.NewRequest("GET", "/tiles/2/1/3.png?sx=10", nil)
+	p := tileParams(r, 2, 1, 3)
+	if p.Errors != nil {
+		t.Errorf("errors: %v", p.Errors)
+	}
+	if p.Sx != tileSize || p.Sy != tileSize {
+		t.Errorf("size %dx%d", p.Sx, p.Sy)
+	}
+	if p.Iter != tileIterCount(2) || p.Map != dflTileMap {
+		t.Errorf("iter %d, map %s", p.Iter, p.Map)
+	}
+	if p.X0 != -1.5 || p.X1 != -0.75 || p.Y0 != 0.75 || p.Y1 != 1.5 {
+		t.Errorf("domain %g,%g %g,%g", p.X0, p.Y0, p.X1, p.Y1)
+	}
+	// Adjacent tiles share their edges
+	q := tileParams(r, 2, 2, 3)
+	if q.X0 != p.X1 || q.Y0 != p.Y0 {
+		t.Errorf("adjacent domain %g,%g", q.X0, q.Y0)
+	}
+	r = httptest.NewRequest("GET", "/tiles/2/1/3.png?iter=500&map=Linear",
+		nil)
+	p = tileParams(r, 2, 1, 3)
+	if p.Iter != 500 || p.Map != "Linear" {
+		t.Errorf("iter %d, map %s", p.Iter, p.Map)
+	}
+}
+
+func TestTileHandler(t *testing.T) {
+	saved, savedEnc := imgCache, encImgCache
+	defer func() { imgCache, encImgCache = saved, savedEnc }()
+	imgCache = newCache(1 << 30)
+	encImgCache = newEncCache(1 << 20)
+	w := httptest.NewRecorder()
+	tileHandler(w, httptest.NewRequest("GET", "/tiles/1/0/1.png", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != tileSize || b.Dy() != tileSize {
+		t.Errorf("tile size %v", b)
+	}
+	w = httptest.NewRecorder()
+	tileHandler(w, httptest.NewRequest("GET", "/tiles/1/2/0.png", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("out of range: status %d", w.Code)
+	}
+}
@@ -0,0 +1,717 @@
+// Zoom animations (the zoom subcommand)
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Number of animation frames
+	maxZoomFrames = 100000
+	dflZoomFrames = 100
+	// Frame rate of Y4M streams (frames per second)
+	dflZoomFPS = 25
+)
+
+// view is a function domain: (Real: [x0 .. x1], Imag: [y0 .. y1]).
+type view struct {
+	x0, y0, x1, y1 float64
+}
+
+func paramsView(p *params) view {
+	return view{p.X0, p.Y0, p.X1, p.Y1}
+}
+
+// zoomAxis interpolates the range of one axis between the ranges of
+// the start and the end view: The size of the range changes
+// exponentially, and the range is scaled about the fixed point of
+// the zoom, so that the zoom proceeds at a steady pace, without
+// drifting. If the size does not change, the range moves linearly.
+type zoomAxis struct {
+	// Center and size of the range at the start view
+	c0, w0 float64
+	// Center at the end view, if the size does not change
+	c1 float64
+	// Size at the end view, relative to the start view
+	s1 float64
+	// Fixed point of the zoom
+	p float64
+}
+
+func newZoomAxis(a0, a1, b0, b1 float64) zoomAxis {
+	za := zoomAxis{c0: (a0 + a1) / 2, w0: a1 - a0, c1: (b0 + b1) / 2}
+	za.s1 = (b1 - b0) / za.w0
+	if za.s1 != 1 {
+		za.p = (za.c1 - za.c0*za.s1) / (1 - za.s1)
+	}
+	return za
+}
+
+// at returns the range at "t" (from 0.0 at the start view to 1.0 at
+// the end view).
+func (za zoomAxis) at(t float64) (float64, float64) {
+	if za.s1 == 1 {
+		c := za.c0 + (za.c1-za.c0)*t
+		return c - za.w0/2, c + za.w0/2
+	}
+	s := math.Pow(za.s1, t)
+	c := za.p + (za.c0-za.p)*s
+	return c - za.w0*s/2, c + za.w0*s/2
+}
+
+// zoomFrames returns the parameters of the "n" frames of the zoom
+// from the view with parameters "p0" to the view with parameters
+// "p1". Views are interpolated exponentially (see zoomAxis), and
+// iteration counts linearly. Frames have the size, palette and color
+// map of "p0".
+func zoomFrames(p0, p1 *params, n int) []*params {
+	xa := newZoomAxis(p0.X0, p0.X1, p1.X0, p1.X1)
+	ya := newZoomAxis(p0.Y0, p0.Y1, p1.Y0, p1.Y1)
+	fs := make([]*params, n)
+	for i := range fs {
+		t := 0.0
+		if n > 1 {
+			t = float64(i) / float64(n-1)
+		}
+		f := *p0
+		f.Errors = nil
+		f.X0, f.X1 = xa.at(t)
+		f.Y0, f.Y1 = ya.at(t)
+		di := float64(p1.Iter-p0.Iter) * t
+		f.Iter = p0.Iter + int(math.Floor(di+0.5))
+		fs[i] = &f
+	}
+	// Exact end view
+	if n > 1 {
+		f := fs[n-1]
+		f.X0, f.Y0, f.X1, f.Y1 = p1.X0, p1.Y0, p1.X1, p1.Y1
+	}
+	return fs
+}
+
+// keyframe is a frame rendered in order to derive (by resampling)
+// the frames first .. last from it.
+type keyframe struct {
+	first, last int
+	p           *params
+}
+
+// keyframes groups consecutive frames, so that each group can be
+// derived from a single keyframe. The keyframe covers the domains of
+// all the frames of its group, with at least their pixel density,
+// and is at most "r" times the size of a frame (in each dimension),
+// and at most maxSx x maxSy pixels. The keyframe's iteration count is
+// the max of its frames (and frames derived from it have this count).
+// If "r" is less than 1, every frame is its own keyframe.
+func keyframes(fs []*params, r float64) []keyframe {
+	var ks []keyframe
+	for i := 0; i < len(fs); {
+		p := *fs[i]
+		v := paramsView(&p)
+		// Min frame width and height in the group
+		mw, mh := v.x1-v.x0, v.y1-v.y0
+		j := i + 1
+		for ; r >= 1 && j < len(fs); j++ {
+			f := fs[j]
+			nv := view{math.Min(v.x0, f.X0), math.Min(v.y0, f.Y0),
+				math.Max(v.x1, f.X1), math.Max(v.y1, f.Y1)}
+			nmw := math.Min(mw, f.X1-f.X0)
+			nmh := math.Min(mh, f.Y1-f.Y0)
+			rx, ry := (nv.x1-nv.x0)/nmw, (nv.y1-nv.y0)/nmh
+			if rx > r || ry > r ||
+				math.Ceil(float64(p.Sx)*rx) > maxSx ||
+				math.Ceil(float64(p.Sy)*ry) > maxSy {
+				break
+			}
+			v, mw, mh = nv, nmw, nmh
+			if f.Iter > p.Iter {
+				p.Iter = f.Iter
+			}
+		}
+		p.X0, p.Y0, p.X1, p.Y1 = v.x0, v.y0, v.x1, v.y1
+		p.Sx = int(math.Ceil(float64(p.Sx) * (v.x1 - v.x0) / mw))
+		p.Sy = int(math.Ceil(float64(p.Sy) * (v.y1 - v.y0) / mh))
+		ks = append(ks, keyframe{first: i, last: j - 1, p: &p})
+		i = j
+	}
+	return ks
+}
+
+// frameWriter writes the frames of a zoom animation.
+type frameWriter interface {
+	// skip returns true if frame "i" was written by a previous run
+	// (when resuming)
+	skip(i int) bool
+	// write writes frame "i"
+	write(i int, img image.Image) error
+	close() error
+}
+
+// zoomRun returns a description of a zoom run: The parameters that
+// determine its frames (see zoomFrames and keyframes). It is recorded
+// with the frames, so that resuming a run with different parameters
+// can be detected.
+func zoomRun(p0, p1 *params, frames int, reuse float64) string {
+	f := func(v view) string {
+		s := make([]string, 4)
+		for i, x := range []float64{v.x0, v.y0, v.x1, v.y1} {
+			s[i] = strconv.FormatFloat(x, 'g', -1, 64)
+		}
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprintf("frames=%d reuse=%g size=%dx%d iter=%d:%d "+
+		"start=%s end=%s %s\n", frames, reuse, p0.Sx, p0.Sy,
+		p0.Iter, p1.Iter, f(paramsView(p0)), f(paramsView(p1)),
+		p0.palQuery())
+}
+
+// runTag returns a short hash of the zoom run description "run".
+func runTag(run string) string {
+	h := sha256.Sum256([]byte(run))
+	return hex.EncodeToString(h[:8])
+}
+
+// pngFrames writes frames as numbered PNG files, named by formatting
+// the frame number with the pattern (e.g. "zoom-%05d.png"). Files are
+// written under a temporary name, and renamed when complete, so that
+// existing files are complete frames. The run's description (see
+// zoomRun) is kept in a file next to the frames, named after the
+// pattern, with extension ".zoom".
+type pngFrames struct {
+	pattern string
+	resume  bool
+}
+
+// newPNGFrames creates a writer of the "n" frames of run "run" (see
+// zoomRun), named by "pattern". If "resume" is true, existing frames
+// are kept; returns non-nil error if they may be from a different
+// run (the run's description does not match, or is missing).
+func newPNGFrames(pattern, run string, n int,
+	resume bool) (*pngFrames, error) {
+	pf := &pngFrames{pattern: pattern, resume: resume}
+	fn := strings.TrimSuffix(pattern, filepath.Ext(pattern)) + ".zoom"
+	if resume {
+		b, err := os.ReadFile(fn)
+		switch {
+		case err == nil && string(b) != run:
+			return nil, fmt.Errorf("%s: Frames are from a run "+
+				"with different parameters; cannot resume", fn)
+		case os.IsNotExist(err):
+			for i := 0; i < n; i++ {
+				if pf.skip(i) {
+					return nil, fmt.Errorf("%s: Missing; "+
+						"cannot resume", fn)
+				}
+			}
+		case err != nil:
+			return nil, err
+		}
+	}
+	if err := os.WriteFile(fn, []byte(run), 0666); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+func (pf *pngFrames) skip(i int) bool {
+	if !pf.resume {
+		return false
+	}
+	_, err := os.Stat(fmt.Sprintf(pf.pattern, i))
+	return err == nil
+}
+
+func (pf *pngFrames) write(i int, img image.Image) error {
+	fn := fmt.Sprintf(pf.pattern, i)
+	f, err := os.Create(fn + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = png.Encode(w, img)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fn + ".tmp")
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+func (pf *pngFrames) close() error { return nil }
+
+// gifFrames collects frames, and writes them as an animated GIF when
+// closed. Resuming is not supported.
+type gifFrames struct {
+	out string
+	g   gif.GIF
+	// Delay between frames (100ths of a second)
+	delay int
+}
+
+func (gf *gifFrames) skip(i int) bool { return false }
+
+func (gf *gifFrames) write(i int, img image.Image) error {
+	var pi *image.Paletted
+	if m, ok := img.(*mandelImg); ok {
+		pi, _ = m.Paletted()
+	}
+	if pi == nil {
+		b := img.Bounds()
+		pi = image.NewPaletted(b, palette.Plan9)
+		draw.FloydSteinberg.Draw(pi, b, img, b.Min)
+	}
+	gf.g.Image = append(gf.g.Image, pi)
+	gf.g.Delay = append(gf.g.Delay, gf.delay)
+	return nil
+}
+
+func (gf *gifFrames) close() error {
+	if len(gf.g.Image) == 0 {
+		return nil
+	}
+	var w io.Writer = os.Stdout
+	if gf.out != "-" {
+		f, err := os.Create(gf.out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	if err := gif.EncodeAll(bw, &gf.g); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// y4mFrames writes frames as a YUV4MPEG2 stream (raw video, with
+// full-range 4:2:0 chroma subsampling), that can be fed to video
+// encoders. When resuming, the frames found complete in the output
+// file are kept, and the rest are appended.
+type y4mFrames struct {
+	w, h int
+	// Frames found in the output file
+	done int
+	f    *os.File
+	bw   *bufio.Writer
+	// Frame buffer: Y, Cb, and Cr planes
+	buf []byte
+}
+
+// newY4MFrames creates a writer of w x h frames at "fps" frames per
+// second to file "out" ("-": standard output), resuming the frames
+// already in the file, if "resume" is true. The stream's header
+// identifies run "run" (see zoomRun), so that only frames of the same
+// run are resumed.
+func newY4MFrames(out string, w, h, fps int, run string,
+	resume bool) (*y4mFrames, error) {
+	yf := &y4mFrames{w: w, h: h}
+	cw, ch := (w+1)/2, (h+1)/2
+	yf.buf = make([]byte, w*h+2*cw*ch)
+	hdr := fmt.Sprintf("YUV4MPEG2 W%d H%d F%d:1 Ip A1:1 C420jpeg "+
+		"XCOLORRANGE=FULL XMANDEL=%s\n", w, h, fps, runTag(run))
+	if out == "-" {
+		if resume {
+			return nil, errors.New("Cannot resume standard output")
+		}
+		yf.f = os.Stdout
+		yf.bw = bufio.NewWriter(yf.f)
+		_, err := yf.bw.WriteString(hdr)
+		return yf, err
+	}
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if resume {
+		flags &^= os.O_TRUNC
+	}
+	f, err := os.OpenFile(out, flags, 0666)
+	if err != nil {
+		return nil, err
+	}
+	yf.f = f
+	// Count the complete frames, and drop the rest
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := int64(0)
+	if fi.Size() > 0 {
+		b := make([]byte, len(hdr))
+		_, err := io.ReadFull(f, b)
+		if err != nil || string(b) != hdr {
+			f.Close()
+			return nil, fmt.Errorf("%s: Not a matching Y4M "+
+				"stream; cannot resume", out)
+		}
+		flen := int64(len("FRAME\n") + len(yf.buf))
+		yf.done = int((fi.Size() - int64(len(hdr))) / flen)
+		size = int64(len(hdr)) + int64(yf.done)*flen
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	yf.bw = bufio.NewWriter(f)
+	if size == 0 {
+		_, err = yf.bw.WriteString(hdr)
+	}
+	return yf, err
+}
+
+func (yf *y4mFrames) skip(i int) bool { return i < yf.done }
+
+func (yf *y4mFrames) write(i int, img image.Image) error {
+	w, h := yf.w, yf.h
+	cw, ch := (w+1)/2, (h+1)/2
+	yp := yf.buf[:w*h]
+	cbp := yf.buf[w*h : w*h+cw*ch]
+	crp := yf.buf[w*h+cw*ch:]
+	b := img.Bounds()
+	// Chroma sums (of up to 4 pixels) and counts
+	cbs := make([]int, cw*ch)
+	crs := make([]int, cw*ch)
+	cn := make([]int, cw*ch)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBAModel.Convert(
+				img.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA)
+			yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+			yp[y*w+x] = yy
+			ci := (y/2)*cw + x/2
+			cbs[ci] += int(cb)
+			crs[ci] += int(cr)
+			cn[ci]++
+		}
+	}
+	for i := range cn {
+		cbp[i] = uint8((cbs[i] + cn[i]/2) / cn[i])
+		crp[i] = uint8((crs[i] + cn[i]/2) / cn[i])
+	}
+	if _, err := yf.bw.WriteString("FRAME\n"); err != nil {
+		return err
+	}
+	_, err := yf.bw.Write(yf.buf)
+	return err
+}
+
+func (yf *y4mFrames) close() error {
+	err := yf.bw.Flush()
+	if yf.f != os.Stdout {
+		if cerr := yf.f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// zoomFormat returns the output format for output "out": "format", if
+// not empty, or else the output file's extension (y4m for standard
+// output). Returns non-nil error if the format is not supported.
+func zoomFormat(out, format string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(out), ".")
+		if out == "-" {
+			format = "y4m"
+		}
+	}
+	switch strings.ToLower(format) {
+	case "png":
+		return "png", nil
+	case "gif":
+		return "gif", nil
+	case "y4m":
+		return "y4m", nil
+	}
+	return "", fmt.Errorf("Unsupported format %q", format)
+}
+
+// parseFloats parses "s" as "n" numbers separated by "sep".
+func parseFloats(s, sep string, n int) ([]float64, error) {
+	f := strings.Split(s, sep)
+	if len(f) != n {
+		return nil, fmt.Errorf("Invalid value %q: Need %d numbers",
+			s, n)
+	}
+	v := make([]float64, n)
+	for i := range f {
+		x, err := strconv.ParseFloat(strings.TrimSpace(f[i]), 64)
+		if err != nil || math.IsNaN(x) || math.IsInf(x, 0) {
+			return nil, fmt.Errorf("Invalid value %q", s)
+		}
+		v[i] = x
+	}
+	return v, nil
+}
+
+// withView returns a copy of the URL query parameters "v", with the
+// domain of view "dv".
+func withView(v url.Values, dv view) url.Values {
+	nv := url.Values{}
+	for k, s := range v {
+		nv[k] = s
+	}
+	f := func(x float64) string {
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	nv.Set("x0", f(dv.x0))
+	nv.Set("y0", f(dv.y0))
+	nv.Set("x1", f(dv.x1))
+	nv.Set("y1", f(dv.y1))
+	return nv
+}
+
+// zoomViews returns the parameters of the start and the end view of
+// a zoom. The start view has the image parameters "v". The end view
+// is given either as "end" (a domain: "x0,y0,x1,y1"), or as "center"
+// ("x,y") and "zoom" (zoom factor range "[z0:]z1"). In the latter
+// case both views are centered at "center", and scaled down by the
+// zoom factors (z0 defaults to 1) from the domain given by "v". The
+// end view's iteration count is "endIter", or, if zero, the start
+// view's count plus tileIterZ for every doubling of the zoom. Both
+// views are validated as the parameters of /mandel, and the invalid
+// parameters are listed in their Errors (the caller reports them).
+// Returns non-nil error if the end view is missing or malformed, or
+// if a view's domain is empty.
+func zoomViews(v url.Values, end, center, zoom string,
+	endIter int) (*params, *params, error) {
+	p0 := valuesParams(v)
+	var v1 view
+	switch {
+	case end != "" && center == "" && zoom == "":
+		e, err := parseFloats(end, ",", 4)
+		if err != nil {
+			return nil, nil, fmt.Errorf("-end: %v", err)
+		}
+		v1 = view{e[0], e[1], e[2], e[3]}
+	case end == "" && center != "" && zoom != "":
+		c, err := parseFloats(center, ",", 2)
+		if err != nil {
+			return nil, nil, fmt.Errorf("-center: %v", err)
+		}
+		zs := strings.Split(zoom, ":")
+		if len(zs) == 1 {
+			zs = []string{"1", zs[0]}
+		}
+		z, err := parseFloats(strings.Join(zs, ":"), ":", 2)
+		if err != nil || z[0] <= 0 || z[1] <= 0 {
+			return nil, nil, fmt.Errorf("-zoom: Invalid value %q",
+				zoom)
+		}
+		w, h := p0.X1-p0.X0, p0.Y1-p0.Y0
+		at := func(z float64) view {
+			return view{c[0] - w/z/2, c[1] - h/z/2,
+				c[0] + w/z/2, c[1] + h/z/2}
+		}
+		v = withView(v, at(z[0]))
+		p0 = valuesParams(v)
+		v1 = at(z[1])
+	default:
+		return nil, nil, errors.New("Either -end, or -center and " +
+			"-zoom must be given")
+	}
+	ev := withView(v, v1)
+	if endIter == 0 {
+		z := (p0.X1 - p0.X0) / (v1.x1 - v1.x0)
+		endIter = p0.Iter + int(math.Floor(tileIterZ*math.Log2(z)+0.5))
+		if endIter < minIter {
+			endIter = minIter
+		} else if endIter > maxIter {
+			endIter = maxIter
+		}
+	}
+	ev.Set("iter", strconv.Itoa(endIter))
+	p1 := valuesParams(ev)
+	for _, p := range []*params{p0, p1} {
+		if p.X1 <= p.X0 || p.Y1 <= p.Y0 {
+			return nil, nil, fmt.Errorf("Empty domain "+
+				"[%g ... %g] x [%g ... %g]",
+				p.X0, p.X1, p.Y0, p.Y1)
+		}
+	}
+	return p0, p1, nil
+}
+
+// renderZoom renders the frames "fs" and writes them with "fw".
+// Frames already written (see frameWriter.skip) are not rendered. If
+// "reuse" is at least 1, frames are derived from keyframes up to
+// "reuse" times their size (see keyframes), instead of being rendered
+// one by one. Progress is reported to "log".
+func renderZoom(ctx context.Context, fs []*params, fw frameWriter,
+	reuse float64, log io.Writer) error {
+	var kimg *mandelImg
+	for _, k := range keyframes(fs, reuse) {
+		kimg = nil
+		for i := k.first; i <= k.last; i++ {
+			if fw.skip(i) {
+				continue
+			}
+			start := time.Now()
+			p := fs[i]
+			var img *mandelImg
+			var err error
+			if k.first == k.last {
+				img, err = getImg(ctx, p)
+			} else {
+				if kimg == nil {
+					kimg, err = getImg(ctx, k.p)
+				}
+				if err == nil {
+					img = kimg.resample(p.Sx, p.Sy,
+						complex(p.X0, p.Y0),
+						complex(p.X1, p.Y1))
+					img = img.Repalette(p.palette())
+					img = img.Remap(p.colorMap())
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("Frame %d: %v", i, err)
+			}
+			if err := fw.write(i, img); err != nil {
+				return fmt.Errorf("Frame %d: %v", i, err)
+			}
+			fmt.Fprintf(log, "Frame %d/%d: [%g ... %g] x [%g ... %g], "+
+				"%d iterations, %v\n", i+1, len(fs),
+				p.X0, p.X1, p.Y0, p.Y1, p.Iter,
+				time.Since(start).Round(time.Millisecond))
+		}
+	}
+	return nil
+}
+
+// zoomCmd implements the zoom subcommand: It renders the frames of a
+// zoom animation, from a start to an end view, and writes them as
+// numbered PNG files, an animated GIF, or a Y4M stream.
+func zoomCmd(args []string) int {
+	fs := cmdFlags("zoom", "[flags] [image flags]")
+	v := url.Values{}
+	for _, f := range imgFlags {
+		fs.Var(&paramFlag{v, f.name, f.isBool}, f.name, f.usage)
+	}
+	end := fs.String("end", "", "End view: \"x0,y0,x1,y1\"")
+	center := fs.String("center", "",
+		"Zoom center: \"x,y\" (with -zoom, instead of -end)")
+	zoom := fs.String("zoom", "",
+		"Zoom factor range: \"[z0:]z1\", relative to the image "+
+			"flags' domain (with -center)")
+	endIter := fs.Int("end-iter", 0,
+		"Iterations at the end view (default: -iter plus 48 per "+
+			"zoom doubling)")
+	frames := fs.Int("frames", dflZoomFrames, "Number of frames")
+	out := fs.String("o", "zoom-%05d.png",
+		"Output: File name pattern for PNG frames, or file for GIF "+
+			"and Y4M (\"-\": standard output)")
+	format := fs.String("format", "",
+		"Output format: png (numbered files), gif, or y4m "+
+			"(default: from the output's extension)")
+	fps := fs.Int("fps", dflZoomFPS, "Frame rate (Y4M)")
+	delay := fs.Int("delay", 4,
+		"Delay between frames, in 100ths of a second (GIF)")
+	reuse := fs.Float64("reuse", 0,
+		"Derive frames from keyframes up to this many times their "+
+			"size (0: render every frame)")
+	resume := fs.Bool("resume", false,
+		"Resume an interrupted run: Keep the frames already written "+
+			"(PNG, Y4M)")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	fail := func(err error) int {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *frames < 1 || *frames > maxZoomFrames {
+		return fail(fmt.Errorf("-frames: %d out of range [1, %d]",
+			*frames, maxZoomFrames))
+	}
+	f, err := zoomFormat(*out, *format)
+	if err != nil {
+		return fail(err)
+	}
+	if err := initCaches(); err != nil {
+		return fail(err)
+	}
+	p0, p1, err := zoomViews(v, *end, *center, *zoom, *endIter)
+	if err != nil {
+		return fail(err)
+	}
+	strict := reportErrors("start view: ", p0.Errors, p0.Strict)
+	if err := reportErrors("end view: ", p1.Errors, p1.Strict); err != nil {
+		strict = err
+	}
+	if strict != nil {
+		return fail(strict)
+	}
+	run := zoomRun(p0, p1, *frames, *reuse)
+	var fw frameWriter
+	switch f {
+	case "png":
+		if !strings.Contains(*out, "%") {
+			return fail(errors.New("-o: PNG output needs a file " +
+				"name pattern, e.g. \"zoom-%05d.png\""))
+		}
+		fw, err = newPNGFrames(*out, run, *frames, *resume)
+		if err != nil {
+			return fail(err)
+		}
+	case "gif":
+		if int64(*frames)*int64(p0.Sx)*int64(p0.Sy) > maxAnimPix {
+			return fail(errors.New("Animation too large for GIF"))
+		}
+		fw = &gifFrames{out: *out, delay: *delay}
+	case "y4m":
+		fw, err = newY4MFrames(*out, p0.Sx, p0.Sy, *fps, run,
+			*resume)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = renderZoom(ctx, zoomFrames(p0, p1, *frames), fw, *reuse,
+		os.Stderr)
+	if cerr := fw.close(); err == nil {
+		err = cerr
+	}
+	waitCaches()
+	if err != nil {
+		if ctx.Err() != nil && f != "gif" {
+			err = fmt.Errorf("%v; run again with -resume to "+
+				"continue", err)
+		}
+		return fail(err)
+	}
+	return 0
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestZoomFrames(t *testing.T) {
+	p0 := &params{Sx: 64, Sy: 48, Iter: 100,
+		X0: -2, Y0: -1.5, X1: 1, Y1: 1.5}
+	// Zoom by 8 into (-0.5, 0.25)
+	p1 := &params{Iter: 400, X0: -0.5 - 3.0/16, Y0: 0.25 - 3.0/16,
+		X1: -0.5 + 3.0/16, Y1: 0.25 + 3.0/16}
+	fs := zoomFrames(p0, p1, 4)
+	if len(fs) != 4 {
+		t.Fatalf("%d frames", len(fs))
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-12 }
+	f0, f3 := fs[0], fs[3]
+	if !near(f0.X0, p0.X0) || !near(f0.Y1, p0.Y1) || f0.Iter != 100 {
+		t.Errorf("start: %+v", *f0)
+	}
+	if f3.X0 != p1.X0 || f3.Y1 != p1.Y1 || f3.Iter != 400 {
+		t.Errorf("end: %+v", *f3)
+	}
+	for i, f := range fs {
+		// Widths halve at every frame
+		if w := f.X1 - f.X0; !near(w, 3/math.Pow(2, float64(i))) {
+			t.Errorf("frame %d: width %g", i, w)
+		}
+		if f.Sx != 64 || f.Sy != 48 || f.Iter != 100+100*i {
+			t.Errorf("frame %d: %+v", i, *f)
+		}
+		// The fixed point is at the same relative position
+		rx := (-0.5 - f.X0) / (f.X1 - f.X0)
+		ry := (1.0/7*2 - f.Y0) / (f.Y1 - f.Y0)
+		if !near(rx, 0.5) || !near(ry, (2.0/7+1.5)/3) {
+			t.Errorf("frame %d: fixed point at %g", i, rx)
+		}
+	}
+
+	// Pan, without zooming
+	p1 = &params{Iter: 100, X0: -1, Y0: -1.5, X1: 2, Y1: 1.5}
+	fs = zoomFrames(p0, p1, 3)
+	if f := fs[1]; !near(f.X0, -1.5) || !near(f.X1, 1.5) {
+		t.Errorf("pan: %+v", *f)
+	}
+}
+
+func TestKeyframes(t *testing.T) {
+	p0 := &params{Sx: 100, Sy: 100, Iter: 100, X0: 0, Y0: 0, X1: 1, Y1: 1}
+	p1 := &params{Iter: 200, X0: 0, Y0: 0, X1: 1.0 / 16, Y1: 1.0 / 16}
+	fs := zoomFrames(p0, p1, 9)
+	// Every frame is half the size of the one two before it
+	ks := keyframes(fs, 2.01)
+	if len(ks) != 3 {
+		t.Fatalf("%d keyframes: %+v", len(ks), ks)
+	}
+	for i, k := range ks {
+		if k.first != 3*i || k.last != 3*i+2 {
+			t.Errorf("keyframe %d: frames %d .. %d", i, k.first, k.last)
+		}
+		f := fs[k.first]
+		if k.p.X0 != f.X0 || k.p.X1 != f.X1 || k.p.Sx < 200 ||
+			k.p.Sx > 201 || k.p.Iter != fs[k.last].Iter {
+			t.Errorf("keyframe %d: %+v", i, *k.p)
+		}
+	}
+	if ks := keyframes(fs, 0); len(ks) != len(fs) {
+		t.Errorf("no reuse: %d keyframes", len(ks))
+	}
+	// Keyframes are limited to maxSx x maxSy
+	p0.Sx, p0.Sy = maxSx/3, maxSy/3
+	fs = zoomFrames(p0, p1, 9)
+	ks = keyframes(fs, 8)
+	for _, k := range ks {
+		if k.p.Sx > maxSx || k.p.Sy > maxSy {
+			t.Errorf("keyframe %dx%d", k.p.Sx, k.p.Sy)
+		}
+	}
+	// Groups of 4 frames (up to 2.83 times the frame size)
+	if len(ks) != 3 || ks[0].last != 3 {
+		t.Errorf("keyframes: %+v", ks)
+	}
+}
+
+func TestY4MFrames(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "z.y4m")
+	img := image.NewRGBA(image.Rect(0, 0, 5, 3))
+	yf, err := newY4MFrames(out, 5, 3, 25, "run", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := yf.write(i, img); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := yf.close(); err != nil {
+		t.Fatal(err)
+	}
+	hdr := "YUV4MPEG2 W5 H3 F25:1 Ip A1:1 C420jpeg XCOLORRANGE=FULL " +
+		"XMANDEL=" + runTag("run") + "\n"
+	// Frame: "FRAME\n", 5x3 Y, 3x2 Cb and Cr
+	flen := 6 + 15 + 2*6
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), hdr) || len(b) != len(hdr)+2*flen {
+		t.Fatalf("got %d bytes: %q", len(b), b)
+	}
+	// Black: Y 0, Cb and Cr 128
+	if f := b[len(hdr)+flen:]; string(f[:6]) != "FRAME\n" || f[6] != 0 ||
+		f[6+15] != 128 || f[len(f)-1] != 128 {
+		t.Errorf("frame: %v", f)
+	}
+
+	// Resume after a partial frame
+	if err := os.WriteFile(out, b[:len(b)-5], 0666); err != nil {
+		t.Fatal(err)
+	}
+	yf, err = newY4MFrames(out, 5, 3, 25, "run", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if yf.done != 1 || !yf.skip(0) || yf.skip(1) {
+		t.Errorf("resume: %d frames done", yf.done)
+	}
+	if err := yf.write(1, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := yf.close(); err != nil {
+		t.Fatal(err)
+	}
+	if nb, _ := os.ReadFile(out); string(nb) != string(b) {
+		t.Errorf("resumed: got %d bytes", len(nb))
+	}
+	// Resume with a different size, or run
+	if _, err := newY4MFrames(out, 6, 3, 25, "run", true); err == nil {
+		t.Error("resumed mismatching stream")
+	}
+	if _, err := newY4MFrames(out, 5, 3, 25, "run2", true); err == nil {
+		t.Error("resumed stream of another run")
+	}
+}
+
+func TestZoomCmd(t *testing.T) {
+	saved, savedEnc := imgCache, encImgCache
+	defer func() { imgCache, encImgCache = saved, savedEnc }()
+	dir := t.TempDir()
+	pat := filepath.Join(dir, "z-%02d.png")
+	args := []string{"-sx", "64", "-sy", "48", "-iter", "32",
+		"-center", "-0.75,0.1", "-zoom", "16", "-frames", "5",
+		"-reuse", "2", "-o", pat}
+	if rc := zoomCmd(args); rc != 0 {
+		t.Fatalf("exit status %d", rc)
+	}
+	fns, _ := filepath.Glob(filepath.Join(dir, "*.png"))
+	if len(fns) != 5 {
+		t.Fatalf("files: %v", fns)
+	}
+	// Resume: Only the missing frame is written
+	if err := os.Remove(fns[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fns[3], nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if rc := zoomCmd(append(args[:len(args):len(args)],
+		"-resume")); rc != 0 {
+		t.Fatalf("resume: exit status %d", rc)
+	}
+	for i, fn := range fns {
+		fi, err := os.Stat(fn)
+		if err != nil || (fi.Size() == 0) != (i == 3) {
+			t.Errorf("%s: %v, %v", fn, fi, err)
+		}
+	}
+
+	// Resume with different parameters
+	if rc := zoomCmd(append(args, "-reuse", "0", "-resume")); rc != 1 {
+		t.Errorf("resumed another run: exit status %d", rc)
+	}
+
+	if rc := zoomCmd([]string{"-frames", "2"}); rc != 1 {
+		t.Errorf("no end view: exit status %d", rc)
+	}
+	if rc := zoomCmd([]string{"-end", "1,2,3", "-frames", "2",
+		"-o", filepath.Join(dir, "z.y4m")}); rc != 1 {
+		t.Errorf("bad end view: exit status %d", rc)
+	}
+}